@@ -0,0 +1,188 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTooManyConns is passed to OnReject for a conn rejected by MaxConnsPerIP.
+	ErrTooManyConns = errors.New("too many conns from the source")
+
+	// ErrAcceptRate is passed to OnReject for a conn rejected by AcceptRate or AcceptRatePerIP.
+	ErrAcceptRate = errors.New("accept rate exceeded")
+)
+
+const admissionSweepInterval = time.Second
+
+type sourceAdmission struct {
+	conns  int
+	bucket tokenBucket
+}
+
+// admission limits the conns accepted globally and for each source.
+type admission struct {
+	mux sync.Mutex
+
+	maxConnsPerIP int
+	rate          float64
+	bucket        tokenBucket
+	ratePerIP     float64
+	burstPerIP    int
+	v4Mask        net.IPMask
+	v6Mask        net.IPMask
+
+	sources   map[string]*sourceAdmission
+	lastSweep time.Time
+}
+
+// newAdmission returns nil if nothing is limited.
+func newAdmission(conf *Config) *admission {
+	if conf.MaxConnsPerIP <= 0 && conf.AcceptRate <= 0 && conf.AcceptRatePerIP <= 0 {
+		return nil
+	}
+	v4Prefix, v6Prefix := conf.IPv4PrefixLen, conf.IPv6PrefixLen
+	if v4Prefix <= 0 || v4Prefix > 32 {
+		v4Prefix = 32
+	}
+	if v6Prefix <= 0 || v6Prefix > 128 {
+		v6Prefix = 128
+	}
+	now := time.Now()
+	a := &admission{
+		maxConnsPerIP: conf.MaxConnsPerIP,
+		rate:          conf.AcceptRate,
+		ratePerIP:     conf.AcceptRatePerIP,
+		burstPerIP:    conf.AcceptBurstPerIP,
+		v4Mask:        net.CIDRMask(v4Prefix, 32),
+		v6Mask:        net.CIDRMask(v6Prefix, 128),
+		sources:       map[string]*sourceAdmission{},
+		lastSweep:     now,
+	}
+	if a.rate > 0 {
+		a.bucket = newTokenBucket(a.rate, conf.AcceptBurst, now)
+	}
+	return a
+}
+
+// sourceKey returns the prefix of the remote ip, or "" for non-ip addrs.
+func (a *admission) sourceKey(remote net.Addr) string {
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4.Mask(a.v4Mask))
+	}
+	if ip = ip.To16(); ip != nil {
+		return string(ip.Mask(a.v6Mask))
+	}
+	return ""
+}
+
+// admit returns the key to release when the conn is closed, or the reason to reject it.
+func (a *admission) admit(remote net.Addr) (string, error) {
+	now := time.Now()
+	key := ""
+	if a.maxConnsPerIP > 0 || a.ratePerIP > 0 {
+		key = a.sourceKey(remote)
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if now.Sub(a.lastSweep) >= admissionSweepInterval {
+		a.sweep(now)
+	}
+
+	var src *sourceAdmission
+	if key != "" {
+		src = a.sources[key]
+		if src == nil {
+			src = &sourceAdmission{}
+			if a.ratePerIP > 0 {
+				src.bucket = newTokenBucket(a.ratePerIP, a.burstPerIP, now)
+			}
+			a.sources[key] = src
+		}
+		if a.maxConnsPerIP > 0 && src.conns >= a.maxConnsPerIP {
+			return "", ErrTooManyConns
+		}
+		if a.ratePerIP > 0 && !src.bucket.take(now, 1) {
+			return "", ErrAcceptRate
+		}
+	}
+	if a.rate > 0 && !a.bucket.take(now, 1) {
+		if src != nil && a.ratePerIP > 0 {
+			// the source is not charged for a conn rejected by the global limit
+			src.bucket.refund(1)
+		}
+		return "", ErrAcceptRate
+	}
+	if src == nil || a.maxConnsPerIP <= 0 {
+		return "", nil
+	}
+	src.conns++
+	return key, nil
+}
+
+func (a *admission) release(key string) {
+	a.mux.Lock()
+	if src := a.sources[key]; src != nil && src.conns > 0 {
+		src.conns--
+	}
+	a.mux.Unlock()
+}
+
+// sweep removes the sources without conns and whose buckets are full, it should be called with the lock held.
+func (a *admission) sweep(now time.Time) {
+	a.lastSweep = now
+	for key, src := range a.sources {
+		if src.conns == 0 && (a.ratePerIP <= 0 || src.bucket.full(now)) {
+			delete(a.sources, key)
+		}
+	}
+}
+
+// admit applies the filters and the admission control to a conn accepted,
+// which is passed to OnReject and closed if it's rejected.
+func (g *Gopher) admit(conn net.Conn) (string, bool) {
+	if !g.accept(conn.RemoteAddr()) {
+		g.reject(conn, ErrDenied)
+		return "", false
+	}
+	if g.admission == nil {
+		return "", true
+	}
+	key, err := g.admission.admit(conn.RemoteAddr())
+	if err != nil {
+		g.reject(conn, err)
+		return "", false
+	}
+	return key, true
+}
+
+func (g *Gopher) reject(conn net.Conn, err error) {
+	atomic.AddUint64(&g.stats.rejected, 1)
+	g.onReject(conn, err)
+	conn.Close()
+}
+
+// releaseAdmission is called when a conn admitted is closed.
+func (g *Gopher) releaseAdmission(key string) {
+	if key != "" {
+		g.admission.release(key)
+	}
+}
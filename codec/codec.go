@@ -0,0 +1,135 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"errors"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/mempool"
+)
+
+const (
+	// DefaultMaxSize .
+	DefaultMaxSize = 1024 * 1024
+)
+
+var (
+	// ErrTooLarge is returned when a message is larger than the max size of the codec.
+	ErrTooLarge = errors.New("message too large")
+
+	// ErrInvalidMessage is returned by Encode when a message doesn't fit the codec,
+	// such as a message containing the delimiter, or of another size than FixedCodec's.
+	ErrInvalidMessage = errors.New("invalid message")
+
+	errSessionUsed = errors.New("session used by others")
+)
+
+// Codec splits a stream into messages, and frames messages to be written.
+type Codec interface {
+	// Decode returns the first message in b and the size of its frame,
+	// size 0 means b doesn't contain a whole frame yet. msg may refer to b.
+	Decode(b []byte) (msg []byte, size int, err error)
+
+	// Encode returns the frame of msg in a buffer from mempool.
+	Encode(msg []byte) ([]byte, error)
+}
+
+// Decoder reassembles the data of a Conn into messages by a Codec.
+type Decoder struct {
+	codec     Codec
+	onMessage func(c *nbio.Conn, msg []byte)
+	buffer    []byte
+}
+
+// NewDecoder returns a Decoder for a Conn, which calls onMessage for each message.
+func NewDecoder(codec Codec, onMessage func(c *nbio.Conn, msg []byte)) *Decoder {
+	if codec == nil || onMessage == nil {
+		panic("invalid nil codec or handler")
+	}
+	return &Decoder{codec: codec, onMessage: onMessage}
+}
+
+// Decode calls onMessage for each message completed by data, msg is valid only during onMessage.
+// the partial frame left is copied to a buffer from mempool, which is released after the frame is completed,
+// or left to the gc if the Conn is closed before that. it should not be called concurrently.
+func (d *Decoder) Decode(c *nbio.Conn, data []byte) error {
+	buffered := len(d.buffer) > 0
+	if buffered {
+		n := len(d.buffer)
+		d.buffer = mempool.Realloc(d.buffer, n+len(data))
+		copy(d.buffer[n:], data)
+		data = d.buffer
+	}
+
+	for len(data) > 0 {
+		msg, size, err := d.codec.Decode(data)
+		if err != nil {
+			d.release()
+			return err
+		}
+		if size == 0 {
+			break
+		}
+		d.onMessage(c, msg)
+		data = data[size:]
+	}
+
+	switch {
+	case len(data) == 0:
+		d.release()
+	case buffered:
+		d.buffer = d.buffer[:copy(d.buffer, data)]
+	default:
+		d.buffer = mempool.Malloc(len(data))
+		copy(d.buffer, data)
+	}
+	return nil
+}
+
+// Buffered returns the size of the partial frame buffered.
+func (d *Decoder) Buffered() int {
+	return len(d.buffer)
+}
+
+func (d *Decoder) release() {
+	if d.buffer != nil {
+		mempool.Free(d.buffer)
+		d.buffer = nil
+	}
+}
+
+// WrapData returns a data handler of nbio.Gopher, which reassembles the data of each Conn into messages by codec
+// and calls onMessage for each message. a Conn is closed with the error if its data fails to be decoded.
+// the Decoder of a Conn is set as its session, create a Decoder for each Conn and call Decoder.Decode
+// in the data handler instead if the session is used by the application.
+func WrapData(codec Codec, onMessage func(c *nbio.Conn, msg []byte)) func(c *nbio.Conn, data []byte) {
+	if codec == nil || onMessage == nil {
+		panic("invalid nil codec or handler")
+	}
+	return func(c *nbio.Conn, data []byte) {
+		d, ok := c.Session().(*Decoder)
+		if !ok {
+			d = NewDecoder(codec, onMessage)
+			if !c.SetSession(d) {
+				c.CloseWithError(errSessionUsed)
+				return
+			}
+		}
+		if err := d.Decode(c, data); err != nil {
+			c.CloseWithError(err)
+		}
+	}
+}
+
+// Write encodes msg by codec and writes the frame to c.
+func Write(c *nbio.Conn, codec Codec, msg []byte) error {
+	b, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(b)
+	return err
+}
@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio"
+)
+
+func TestCodecs(t *testing.T) {
+	lengthCodecs := []Codec{}
+	for _, size := range []int{1, 2, 4, 8} {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			lc, err := NewLengthFieldCodec(size, order, 200)
+			if err != nil {
+				t.Fatalf("NewLengthFieldCodec failed: %v", err)
+			}
+			lengthCodecs = append(lengthCodecs, lc)
+		}
+	}
+	msgs := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 200), []byte("world")}
+	for _, c := range lengthCodecs {
+		testCodec(t, c, msgs)
+	}
+	testCodec(t, &DelimiterCodec{Delimiter: []byte("\r\n\r\n"), MaxSize: 200}, msgs)
+	testCodec(t, &LineCodec{MaxSize: 200}, msgs)
+	testCodec(t, &FixedCodec{Size: 5}, [][]byte{[]byte("hello"), []byte("world"), []byte("12345")})
+
+	var got []string
+	d := NewDecoder(&LineCodec{}, func(c *nbio.Conn, msg []byte) {
+		got = append(got, string(msg))
+	})
+	if err := d.Decode(nil, []byte("a\r\nb\nc\r")); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" || d.Buffered() != 2 {
+		t.Fatalf("invalid lines: %q, %v", got, d.Buffered())
+	}
+}
+
+func testCodec(t *testing.T, c Codec, msgs [][]byte) {
+	var stream []byte
+	for _, msg := range msgs {
+		b, err := c.Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode failed: %T, %v", c, err)
+		}
+		stream = append(stream, b...)
+	}
+	for _, chunk := range []int{1, 3, 7, len(stream)} {
+		var got [][]byte
+		d := NewDecoder(c, func(c *nbio.Conn, msg []byte) {
+			got = append(got, append([]byte{}, msg...))
+		})
+		for data := stream; len(data) > 0; {
+			n := chunk
+			if n > len(data) {
+				n = len(data)
+			}
+			if err := d.Decode(nil, data[:n]); err != nil {
+				t.Fatalf("Decode failed: %T, %v", c, err)
+			}
+			data = data[n:]
+		}
+		if len(got) != len(msgs) || d.Buffered() != 0 {
+			t.Fatalf("invalid messages num: %T, %v, %v", c, len(got), d.Buffered())
+		}
+		for i := range msgs {
+			if !bytes.Equal(got[i], msgs[i]) {
+				t.Fatalf("invalid message: %T, %q", c, got[i])
+			}
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	lc := &LengthFieldCodec{FieldSize: 2, MaxSize: 10}
+	if _, err := lc.Encode(make([]byte, 11)); err != ErrTooLarge {
+		t.Fatalf("Encode too large: %v", err)
+	}
+	if _, _, err := lc.Decode([]byte{0, 11}); err != ErrTooLarge {
+		t.Fatalf("Decode too large: %v", err)
+	}
+	if _, err := (&LengthFieldCodec{FieldSize: 1}).Encode(make([]byte, 256)); err != ErrTooLarge {
+		t.Fatalf("Encode overflow: %v", err)
+	}
+	dc := &DelimiterCodec{Delimiter: []byte("\n"), MaxSize: 10}
+	if _, _, err := dc.Decode(make([]byte, 10)); err != nil {
+		t.Fatalf("Decode partial: %v", err)
+	}
+	if _, _, err := dc.Decode(make([]byte, 11)); err != ErrTooLarge {
+		t.Fatalf("Decode too large: %v", err)
+	}
+	if _, err := dc.Encode([]byte("a\nb")); err != ErrInvalidMessage {
+		t.Fatalf("Encode delimiter: %v", err)
+	}
+	if _, err := (&FixedCodec{Size: 4}).Encode([]byte("abc")); err != ErrInvalidMessage {
+		t.Fatalf("Encode fixed: %v", err)
+	}
+}
+
+func TestWrapData(t *testing.T) {
+	addr := "127.0.0.1:8911"
+	lc, _ := NewLengthFieldCodec(4, nil, 0)
+	g := nbio.NewGopher(nbio.Config{
+		Network: "tcp",
+		Addrs:   []string{addr},
+	})
+	g.OnData(WrapData(lc, func(c *nbio.Conn, msg []byte) {
+		Write(c, lc, msg)
+	}))
+	err := g.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	frame, _ := lc.Encode([]byte("hello"))
+	frames := append(append([]byte{}, frame...), frame...)
+	// a frame split between writes
+	conn.Write(frames[:7])
+	time.Sleep(time.Second / 20)
+	conn.Write(frames[7:])
+	buf := make([]byte, len(frames))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, frames) {
+		t.Fatalf("read echo failed: %q, %v", buf, err)
+	}
+
+	// a frame too large closes the conn
+	conn.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("conn not closed: %v", err)
+	}
+}
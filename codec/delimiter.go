@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/lesismal/nbio/mempool"
+)
+
+var errEmptyDelimiter = errors.New("invalid empty delimiter")
+
+// DelimiterCodec frames a message with a delimiter after it, the message must not contain the delimiter.
+type DelimiterCodec struct {
+	// Delimiter represents the bytes ending a message.
+	Delimiter []byte
+
+	// MaxSize represents the max size of a message without the delimiter, it's set to DefaultMaxSize by default.
+	MaxSize int
+}
+
+// Decode implements Codec.
+func (dc *DelimiterCodec) Decode(b []byte) ([]byte, int, error) {
+	return decodeDelimited(b, dc.Delimiter, dc.MaxSize)
+}
+
+// Encode implements Codec.
+func (dc *DelimiterCodec) Encode(msg []byte) ([]byte, error) {
+	return encodeDelimited(msg, dc.Delimiter, dc.MaxSize)
+}
+
+// LineCodec frames a message as a line ending with "\n", a "\r" before "\n" is trimmed by Decode.
+type LineCodec struct {
+	// MaxSize represents the max size of a line without "\n", it's set to DefaultMaxSize by default.
+	MaxSize int
+}
+
+var lineDelimiter = []byte("\n")
+
+// Decode implements Codec.
+func (lc *LineCodec) Decode(b []byte) ([]byte, int, error) {
+	msg, size, err := decodeDelimited(b, lineDelimiter, lc.MaxSize)
+	if size > 0 && len(msg) > 0 && msg[len(msg)-1] == '\r' {
+		msg = msg[:len(msg)-1]
+	}
+	return msg, size, err
+}
+
+// Encode implements Codec.
+func (lc *LineCodec) Encode(msg []byte) ([]byte, error) {
+	return encodeDelimited(msg, lineDelimiter, lc.MaxSize)
+}
+
+func decodeDelimited(b, delimiter []byte, maxSize int) ([]byte, int, error) {
+	if len(delimiter) == 0 {
+		return nil, 0, errEmptyDelimiter
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	// a delimiter is not looked for beyond maxSize
+	limit := b
+	if len(limit) > maxSize+len(delimiter) {
+		limit = limit[:maxSize+len(delimiter)]
+	}
+	i := bytes.Index(limit, delimiter)
+	if i < 0 {
+		if len(b) >= maxSize+len(delimiter) {
+			return nil, 0, ErrTooLarge
+		}
+		return nil, 0, nil
+	}
+	return b[:i], i + len(delimiter), nil
+}
+
+func encodeDelimited(msg, delimiter []byte, maxSize int) ([]byte, error) {
+	if len(delimiter) == 0 {
+		return nil, errEmptyDelimiter
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if len(msg) > maxSize {
+		return nil, ErrTooLarge
+	}
+	if bytes.Contains(msg, delimiter) {
+		return nil, ErrInvalidMessage
+	}
+	b := mempool.Malloc(len(msg) + len(delimiter))
+	copy(b[copy(b, msg):], delimiter)
+	return b, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"errors"
+
+	"github.com/lesismal/nbio/mempool"
+)
+
+var errInvalidFixedSize = errors.New("invalid fixed size")
+
+// FixedCodec frames messages of the same size without any header or delimiter.
+type FixedCodec struct {
+	// Size represents the size of each message.
+	Size int
+}
+
+// Decode implements Codec.
+func (fc *FixedCodec) Decode(b []byte) ([]byte, int, error) {
+	if fc.Size <= 0 {
+		return nil, 0, errInvalidFixedSize
+	}
+	if len(b) < fc.Size {
+		return nil, 0, nil
+	}
+	return b[:fc.Size], fc.Size, nil
+}
+
+// Encode implements Codec, msg must be of Size.
+func (fc *FixedCodec) Encode(msg []byte) ([]byte, error) {
+	if fc.Size <= 0 {
+		return nil, errInvalidFixedSize
+	}
+	if len(msg) != fc.Size {
+		return nil, ErrInvalidMessage
+	}
+	b := mempool.Malloc(fc.Size)
+	copy(b, msg)
+	return b, nil
+}
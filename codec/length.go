@@ -0,0 +1,110 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/lesismal/nbio/mempool"
+)
+
+var errInvalidFieldSize = errors.New("invalid length field size")
+
+// LengthFieldCodec frames a message with a header of its length.
+type LengthFieldCodec struct {
+	// FieldSize represents the size of the length field, 1, 2, 4 or 8.
+	FieldSize int
+
+	// ByteOrder represents the byte order of the length field, it's set to binary.BigEndian by default.
+	ByteOrder binary.ByteOrder
+
+	// MaxSize represents the max size of a message, it's set to DefaultMaxSize by default.
+	MaxSize int
+}
+
+// NewLengthFieldCodec returns a LengthFieldCodec, order nil means binary.BigEndian, and maxSize <= 0 means DefaultMaxSize.
+func NewLengthFieldCodec(fieldSize int, order binary.ByteOrder, maxSize int) (*LengthFieldCodec, error) {
+	switch fieldSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, errInvalidFieldSize
+	}
+	if order == nil {
+		order = binary.BigEndian
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	return &LengthFieldCodec{FieldSize: fieldSize, ByteOrder: order, MaxSize: maxSize}, nil
+}
+
+// Decode implements Codec.
+func (lc *LengthFieldCodec) Decode(b []byte) ([]byte, int, error) {
+	if len(b) < lc.FieldSize {
+		return nil, 0, nil
+	}
+	var length uint64
+	switch lc.FieldSize {
+	case 1:
+		length = uint64(b[0])
+	case 2:
+		length = uint64(lc.byteOrder().Uint16(b))
+	case 4:
+		length = uint64(lc.byteOrder().Uint32(b))
+	case 8:
+		length = lc.byteOrder().Uint64(b)
+	default:
+		return nil, 0, errInvalidFieldSize
+	}
+	if length > uint64(lc.maxSize()) {
+		return nil, 0, ErrTooLarge
+	}
+	size := lc.FieldSize + int(length)
+	if len(b) < size {
+		return nil, 0, nil
+	}
+	return b[lc.FieldSize:size], size, nil
+}
+
+// Encode implements Codec.
+func (lc *LengthFieldCodec) Encode(msg []byte) ([]byte, error) {
+	switch lc.FieldSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, errInvalidFieldSize
+	}
+	length := len(msg)
+	if length > lc.maxSize() || (lc.FieldSize < 8 && uint64(length) >= 1<<(8*uint(lc.FieldSize))) {
+		return nil, ErrTooLarge
+	}
+	b := mempool.Malloc(lc.FieldSize + length)
+	switch lc.FieldSize {
+	case 1:
+		b[0] = byte(length)
+	case 2:
+		lc.byteOrder().PutUint16(b, uint16(length))
+	case 4:
+		lc.byteOrder().PutUint32(b, uint32(length))
+	case 8:
+		lc.byteOrder().PutUint64(b, uint64(length))
+	}
+	copy(b[lc.FieldSize:], msg)
+	return b, nil
+}
+
+func (lc *LengthFieldCodec) byteOrder() binary.ByteOrder {
+	if lc.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return lc.ByteOrder
+}
+
+func (lc *LengthFieldCodec) maxSize() int {
+	if lc.MaxSize <= 0 {
+		return DefaultMaxSize
+	}
+	return lc.MaxSize
+}
@@ -6,9 +6,28 @@ package nbio
 
 import (
 	"net"
+	"strings"
 	"time"
 )
 
+type connType int8
+
+const (
+	connTypeTCP connType = iota
+	connTypeUDPServer
+	connTypeUDPClientFromRead
+	connTypeUDPClientFromDial
+	connTypeUnix
+)
+
+func isUDPNetwork(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
+
+func isUnixNetwork(network string) bool {
+	return network == "unix"
+}
+
 // Dial wraps net.Dial
 func Dial(network string, address string) (*Conn, error) {
 	conn, err := net.Dial(network, address)
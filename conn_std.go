@@ -8,6 +8,7 @@ package nbio
 
 import (
 	"errors"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -15,6 +16,10 @@ import (
 
 // Conn wraps net.Conn
 type Conn struct {
+	stats       connStats
+	idleTimeout int64
+	admitKey    string
+
 	g *Gopher
 
 	hash int
@@ -23,8 +28,22 @@ type Conn struct {
 
 	conn net.Conn
 
-	closed   bool
-	closeErr error
+	closed      bool
+	readClosed  bool
+	writeClosed bool
+	closeErr    error
+
+	readPaused bool
+	chResume   chan struct{}
+
+	reconn *ReconnectConn
+
+	proxy       *proxyReader
+	proxyHeader *ProxyHeader
+
+	rLimited int32
+	rLimiter *rateLimiter
+	wLimiter *rateLimiter
 
 	ReadBuffer []byte
 
@@ -41,6 +60,10 @@ func (c *Conn) Hash() int {
 func (c *Conn) Read(b []byte) (int, error) {
 	c.g.beforeRead(c)
 	nread, err := c.conn.Read(b)
+	c.statsRead(nread)
+	if err == io.EOF || isTimeout(err) {
+		return nread, err
+	}
 	if c.closeErr == nil {
 		c.closeErr = err
 	}
@@ -51,8 +74,12 @@ func (c *Conn) Read(b []byte) (int, error) {
 func (c *Conn) Write(b []byte) (int, error) {
 	c.g.beforeWrite(c)
 
-	nwrite, err := c.conn.Write(b)
-	if err != nil {
+	nwrite, err := c.write(b)
+	c.statsWrite(nwrite)
+	if isTimeout(err) {
+		c.conn.SetWriteDeadline(time.Time{})
+		c.g.onWriteTimeout(c)
+	} else if err != nil {
 		if c.closeErr == nil {
 			c.closeErr = err
 		}
@@ -65,9 +92,12 @@ func (c *Conn) Write(b []byte) (int, error) {
 
 // Writev wraps buffers.WriteTo/syscall.Writev
 func (c *Conn) Writev(in [][]byte) (int, error) {
-	buffers := net.Buffers(in)
-	nwrite, err := buffers.WriteTo(c.conn)
-	if err != nil {
+	nwrite, err := c.writev(in)
+	c.statsWrite(int(nwrite))
+	if isTimeout(err) {
+		c.conn.SetWriteDeadline(time.Time{})
+		c.g.onWriteTimeout(c)
+	} else if err != nil {
 		if c.closeErr == nil {
 			c.closeErr = err
 		}
@@ -84,6 +114,10 @@ func (c *Conn) Close() error {
 	c.mux.Lock()
 	if !c.closed {
 		c.closed = true
+		if c.chResume != nil {
+			close(c.chResume)
+			c.chResume = nil
+		}
 		err := c.conn.Close()
 		c.mux.Unlock()
 		if c.g != nil {
@@ -103,13 +137,104 @@ func (c *Conn) CloseWithError(err error) error {
 	return c.Close()
 }
 
-// LocalAddr wraps net.Conn.LocalAddr
+// CloseWrite shuts down the writing side of the Conn, then the peer reads EOF.
+// the Conn is closed if the reading side has been closed too.
+func (c *Conn) CloseWrite() error {
+	cw, ok := c.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("not supported")
+	}
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return errClosed
+	}
+	c.writeClosed = true
+	readClosed := c.readClosed
+	c.mux.Unlock()
+
+	err := cw.CloseWrite()
+	if err != nil || readClosed {
+		c.CloseWithError(err)
+	}
+	return err
+}
+
+// SpliceTo is supported on linux only.
+func (c *Conn) SpliceTo(dst *Conn) error {
+	return errors.New("not supported")
+}
+
+// CloseRead shuts down the reading side of the Conn and stops reading,
+// the Conn is closed if the writing side has been closed too.
+func (c *Conn) CloseRead() error {
+	cr, ok := c.conn.(interface{ CloseRead() error })
+	if !ok {
+		return errors.New("not supported")
+	}
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return errClosed
+	}
+	c.readClosed = true
+	writeClosed := c.writeClosed
+	c.mux.Unlock()
+
+	err := cr.CloseRead()
+	if err != nil || writeClosed {
+		c.CloseWithError(err)
+	}
+	return err
+}
+
+// readEOF returns whether the Conn is kept open after the reading side is closed.
+func (c *Conn) readEOF() bool {
+	if _, ok := c.conn.(interface{ CloseWrite() error }); !ok {
+		return false
+	}
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return true
+	}
+	byPeer := !c.readClosed
+	c.readClosed = true
+	writeClosed := c.writeClosed
+	c.mux.Unlock()
+
+	if writeClosed {
+		c.CloseWithError(io.EOF)
+	} else if byPeer {
+		c.g.onHalfClose(c)
+	}
+	return true
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (c *Conn) closeIdle(now int64) {
+	if c.isIdle(now) {
+		c.CloseWithError(ErrIdleTimeout)
+	}
+}
+
+// LocalAddr wraps net.Conn.LocalAddr, or returns the destination addr of the PROXY protocol header
 func (c *Conn) LocalAddr() net.Addr {
+	if h := c.proxyHeader; h != nil && !h.Local {
+		return h.DestinationAddr
+	}
 	return c.conn.LocalAddr()
 }
 
-// RemoteAddr wraps net.Conn.RemoteAddr
+// RemoteAddr wraps net.Conn.RemoteAddr, or returns the source addr of the PROXY protocol header
 func (c *Conn) RemoteAddr() net.Addr {
+	if h := c.proxyHeader; h != nil && !h.Local {
+		return h.SourceAddr
+	}
 	return c.conn.RemoteAddr()
 }
 
@@ -211,6 +336,60 @@ func (c *Conn) SetSession(session interface{}) bool {
 	return false
 }
 
+// BufferedWriteSize returns 0 because writing is blocking on windows.
+func (c *Conn) BufferedWriteSize() int {
+	return 0
+}
+
+// SetWriteBufferWatermark does nothing because writing is blocking on windows.
+func (c *Conn) SetWriteBufferWatermark(high, low int) {}
+
+// PauseRead stops reading from the Conn until ResumeRead is called.
+func (c *Conn) PauseRead() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if !c.readPaused {
+		c.readPaused = true
+		c.chResume = make(chan struct{})
+	}
+	return nil
+}
+
+// ResumeRead restarts reading from the Conn paused by PauseRead.
+func (c *Conn) ResumeRead() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.readPaused {
+		c.readPaused = false
+		close(c.chResume)
+		c.chResume = nil
+	}
+	return nil
+}
+
+// IsReadPaused returns whether the Conn's reading is paused.
+func (c *Conn) IsReadPaused() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.readPaused
+}
+
+// waitResume blocks the reading goroutine while the Conn is paused.
+func (c *Conn) waitResume() {
+	c.mux.Lock()
+	ch := c.chResume
+	c.mux.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
 func newConn(conn net.Conn, fromClient ...interface{}) *Conn {
 	c := &Conn{
 		conn: conn,
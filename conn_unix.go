@@ -8,8 +8,10 @@ package nbio
 
 import (
 	"errors"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,21 +20,60 @@ import (
 
 // Conn implements net.Conn
 type Conn struct {
+	stats       connStats
+	idleTimeout int64
+	admitKey    string
+
 	mux sync.Mutex
 
 	g *Gopher
 
 	fd int
 
+	typ    connType
+	udp    *udpConn
+	dialer *dialer
+	reconn *ReconnectConn
+
 	rTimer *htimer
 	wTimer *htimer
+	// rSeq and wSeq tell the timers fired from the ones stopped or replaced
+	rSeq uint64
+	wSeq uint64
+
+	rLimited  int32
+	rLimiter  *rateLimiter
+	wLimiter  *rateLimiter
+	rThrottle *htimer
+	wThrottle *htimer
 
 	leftSize     int
 	writeBuffers [][]byte
 
-	closed   bool
-	isWAdded bool
-	closeErr error
+	wHighWatermark int
+	wLowWatermark  int
+	wAboveHigh     bool
+
+	zeroCopy  bool
+	zcSeq     uint32
+	zcPending []zeroCopyBuffer
+
+	spliceTo   *splicer
+	spliceFrom *splicer
+
+	sendfiles        []*sendfileSegment
+	sendfilesDropped []*sendfileSegment
+
+	proxy       *proxyReader
+	proxyHeader *ProxyHeader
+
+	closed       bool
+	isWAdded     bool
+	readPaused   bool
+	splicePaused bool
+	readClosed   bool
+	writeClosed  bool
+	closeErr     error
 
 	lAddr net.Addr
 	rAddr net.Addr
@@ -44,6 +85,12 @@ type Conn struct {
 	chWaitWrite chan struct{}
 }
 
+// zeroCopyBuffer is a buffer sent with MSG_ZEROCOPY, id is the sequence number of the send.
+type zeroCopyBuffer struct {
+	id  uint32
+	buf []byte
+}
+
 // Hash returns a hash code
 func (c *Conn) Hash() int {
 	return c.fd
@@ -61,6 +108,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 
 	n, err := syscall.Read(int(c.fd), b)
 	if err == nil {
+		c.statsRead(n)
 		c.g.afterRead(c)
 	}
 
@@ -76,16 +124,28 @@ func (c *Conn) Write(b []byte) (int, error) {
 		return -1, errClosed
 	}
 
+	if c.writeClosed {
+		c.mux.Unlock()
+		c.g.onWriteBufferFree(c, b)
+		return -1, errWriteClosed
+	}
+
 	c.g.beforeWrite(c)
 
-	n, err := c.write(b)
+	var n int
+	var err error
+	if len(c.sendfiles) > 0 {
+		n, err = c.queueAfterSendfile([][]byte{b})
+	} else {
+		n, err = c.write(b)
+	}
 	if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
 		c.closeWithErrorWithoutLock(err)
-		c.mux.Unlock()
+		c.unlock()
 		return n, err
 	}
 
-	if len(c.writeBuffers) == 0 {
+	if len(c.writeBuffers) == 0 && len(c.sendfiles) == 0 {
 		if c.wTimer != nil {
 			c.wTimer.Stop()
 		}
@@ -93,7 +153,11 @@ func (c *Conn) Write(b []byte) (int, error) {
 		c.modWrite()
 	}
 
+	onWatermark := c.checkWatermark()
 	c.mux.Unlock()
+	if onWatermark != nil {
+		onWatermark()
+	}
 	return n, err
 }
 
@@ -108,22 +172,32 @@ func (c *Conn) Writev(in [][]byte) (int, error) {
 		return 0, errClosed
 	}
 
+	if c.writeClosed {
+		c.mux.Unlock()
+		for _, v := range in {
+			c.g.onWriteBufferFree(c, v)
+		}
+		return 0, errWriteClosed
+	}
+
 	c.g.beforeWrite(c)
 
 	var n int
 	var err error
-	switch len(in) {
-	case 1:
+	switch {
+	case len(c.sendfiles) > 0:
+		n, err = c.queueAfterSendfile(in)
+	case len(in) == 1:
 		n, err = c.write(in[0])
 	default:
 		n, err = c.writev(in)
 	}
 	if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
 		c.closeWithErrorWithoutLock(err)
-		c.mux.Unlock()
+		c.unlock()
 		return n, err
 	}
-	if len(c.writeBuffers) == 0 {
+	if len(c.writeBuffers) == 0 && len(c.sendfiles) == 0 {
 		if c.wTimer != nil {
 			c.wTimer.Stop()
 		}
@@ -131,7 +205,11 @@ func (c *Conn) Writev(in [][]byte) (int, error) {
 		c.modWrite()
 	}
 
+	onWatermark := c.checkWatermark()
 	c.mux.Unlock()
+	if onWatermark != nil {
+		onWatermark()
+	}
 	return n, err
 }
 
@@ -145,6 +223,104 @@ func (c *Conn) CloseWithError(err error) error {
 	return c.closeWithError(err)
 }
 
+// CloseWrite shuts down the writing side of the Conn after the data buffered is flushed, then the peer reads EOF.
+// Write fails after it, the Conn is closed if the reading side has been closed too. tcp and unix Conns only.
+func (c *Conn) CloseWrite() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.typ != connTypeTCP && c.typ != connTypeUnix {
+		return errors.New("not supported")
+	}
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	if len(c.writeBuffers) > 0 || len(c.sendfiles) > 0 {
+		// shut down by flush
+		return nil
+	}
+	return c.shutdownWrite()
+}
+
+// CloseRead shuts down the reading side of the Conn and stops reading,
+// the Conn is closed if the writing side has been closed too. tcp and unix Conns only.
+func (c *Conn) CloseRead() error {
+	c.mux.Lock()
+	defer c.unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.typ != connTypeTCP && c.typ != connTypeUnix {
+		return errors.New("not supported")
+	}
+	if c.readClosed {
+		return nil
+	}
+	c.readClosed = true
+	if err := syscall.Shutdown(c.fd, syscall.SHUT_RD); err != nil {
+		c.closeWithErrorWithoutLock(err)
+		return err
+	}
+	if c.writeClosed && len(c.writeBuffers) == 0 && len(c.sendfiles) == 0 {
+		c.closeWithErrorWithoutLock(nil)
+		return nil
+	}
+	c.stopRead()
+	return nil
+}
+
+// shutdownWrite should be called with the lock held.
+func (c *Conn) shutdownWrite() error {
+	if err := syscall.Shutdown(c.fd, syscall.SHUT_WR); err != nil {
+		c.closeWithErrorWithoutLock(err)
+		return err
+	}
+	if c.readClosed {
+		c.closeWithErrorWithoutLock(nil)
+	}
+	return nil
+}
+
+// stopRead removes read events for a closed reading side, it should be called with the lock held.
+func (c *Conn) stopRead() {
+	if !c.readPaused {
+		c.readPaused = true
+		c.g.pollers[c.Hash()%len(c.g.pollers)].pauseRead(c.fd, c.isWAdded)
+	}
+}
+
+// readEOF is called by the poller when the peer has shut down its writing side.
+func (c *Conn) readEOF() {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return
+	}
+	c.readClosed = true
+	if c.writeClosed {
+		// both sides are closed, or will be after flushed
+		if len(c.writeBuffers) == 0 && len(c.sendfiles) == 0 {
+			c.closeWithErrorWithoutLock(io.EOF)
+		} else {
+			c.stopRead()
+		}
+		c.mux.Unlock()
+		return
+	}
+	c.mux.Unlock()
+
+	c.g.onHalfClose(c)
+
+	c.mux.Lock()
+	if !c.closed {
+		c.stopRead()
+	}
+	c.mux.Unlock()
+}
+
 // LocalAddr implements LocalAddr
 func (c *Conn) LocalAddr() net.Addr {
 	return c.lAddr
@@ -159,28 +335,8 @@ func (c *Conn) RemoteAddr() net.Addr {
 func (c *Conn) SetDeadline(t time.Time) error {
 	c.mux.Lock()
 	if !c.closed {
-		if !t.IsZero() {
-			now := time.Now()
-			if c.rTimer == nil {
-				c.rTimer = c.g.afterFunc(t.Sub(now), func() { c.closeWithError(errReadTimeout) })
-			} else {
-				c.rTimer.Reset(t.Sub(now))
-			}
-			if c.wTimer == nil {
-				c.wTimer = c.g.afterFunc(t.Sub(now), func() { c.closeWithError(errWriteTimeout) })
-			} else {
-				c.wTimer.Reset(t.Sub(now))
-			}
-		} else {
-			if c.rTimer != nil {
-				c.rTimer.Stop()
-				c.rTimer = nil
-			}
-			if c.wTimer != nil {
-				c.wTimer.Stop()
-				c.wTimer = nil
-			}
-		}
+		c.setReadTimer(t)
+		c.setWriteTimer(t)
 	}
 	c.mux.Unlock()
 	return nil
@@ -190,17 +346,7 @@ func (c *Conn) SetDeadline(t time.Time) error {
 func (c *Conn) SetReadDeadline(t time.Time) error {
 	c.mux.Lock()
 	if !c.closed {
-		if !t.IsZero() {
-			now := time.Now()
-			if c.rTimer == nil {
-				c.rTimer = c.g.afterFunc(t.Sub(now), func() { c.closeWithError(errReadTimeout) })
-			} else {
-				c.rTimer.Reset(t.Sub(now))
-			}
-		} else if c.rTimer != nil {
-			c.rTimer.Stop()
-			c.rTimer = nil
-		}
+		c.setReadTimer(t)
 	}
 	c.mux.Unlock()
 	return nil
@@ -210,24 +356,82 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 func (c *Conn) SetWriteDeadline(t time.Time) error {
 	c.mux.Lock()
 	if !c.closed {
-		if !t.IsZero() {
-			now := time.Now()
-			if c.wTimer == nil {
-				c.wTimer = c.g.afterFunc(t.Sub(now), func() { c.closeWithError(errWriteTimeout) })
-			} else {
-				c.wTimer.Reset(t.Sub(now))
-			}
-		} else if c.wTimer != nil {
+		c.setWriteTimer(t)
+	}
+	c.mux.Unlock()
+	return nil
+}
+
+// setReadTimer should be called with the lock held.
+func (c *Conn) setReadTimer(t time.Time) {
+	if t.IsZero() {
+		if c.rTimer != nil {
+			c.rTimer.Stop()
+			c.rTimer = nil
+		}
+		return
+	}
+	now := time.Now()
+	if c.rTimer != nil {
+		c.rTimer.Reset(t.Sub(now))
+		return
+	}
+	c.rSeq++
+	seq := c.rSeq
+	c.rTimer = c.afterFunc(t.Sub(now), func() { c.readTimeout(seq) })
+}
+
+// setWriteTimer should be called with the lock held.
+func (c *Conn) setWriteTimer(t time.Time) {
+	if t.IsZero() {
+		if c.wTimer != nil {
 			c.wTimer.Stop()
 			c.wTimer = nil
 		}
+		return
+	}
+	now := time.Now()
+	if c.wTimer != nil {
+		c.wTimer.Reset(t.Sub(now))
+		return
+	}
+	c.wSeq++
+	seq := c.wSeq
+	c.wTimer = c.afterFunc(t.Sub(now), func() { c.writeTimeout(seq) })
+}
+
+func (c *Conn) readTimeout(seq uint64) {
+	c.mux.Lock()
+	if c.closed || c.rTimer == nil || c.rSeq != seq {
+		c.mux.Unlock()
+		return
+	}
+	c.rTimer = nil
+	if c.typ == connTypeUDPClientFromRead {
+		c.closeWithErrorWithoutLock(errReadTimeout)
+		c.mux.Unlock()
+		return
 	}
 	c.mux.Unlock()
-	return nil
+	c.g.onReadTimeout(c)
+}
+
+func (c *Conn) writeTimeout(seq uint64) {
+	c.mux.Lock()
+	if c.closed || c.wTimer == nil || c.wSeq != seq {
+		c.mux.Unlock()
+		return
+	}
+	c.wTimer = nil
+	c.mux.Unlock()
+	c.g.onWriteTimeout(c)
 }
 
 // SetNoDelay implements SetNoDelay
 func (c *Conn) SetNoDelay(nodelay bool) error {
+	if c.typ != connTypeTCP {
+		return nil
+	}
 	if nodelay {
 		return syscall.SetsockoptInt(c.fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
 	}
@@ -246,6 +450,9 @@ func (c *Conn) SetWriteBuffer(bytes int) error {
 
 // SetKeepAlive implements SetKeepAlive
 func (c *Conn) SetKeepAlive(keepalive bool) error {
+	if c.typ != connTypeTCP {
+		return nil
+	}
 	if keepalive {
 		return syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
 	}
@@ -291,10 +498,90 @@ func (c *Conn) SetSession(session interface{}) bool {
 	return false
 }
 
+// PauseRead stops reading from the Conn until ResumeRead is called,
+// the peer is blocked by tcp flow control when the kernel's recvQ is full.
+func (c *Conn) PauseRead() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.typ == connTypeUDPClientFromRead {
+		return errors.New("not supported")
+	}
+	if !c.readPaused {
+		disabled := c.readDisabled()
+		c.readPaused = true
+		if disabled {
+			// paused by splice or the rate limits
+			return nil
+		}
+		return c.g.pollers[c.Hash()%len(c.g.pollers)].pauseRead(c.fd, c.isWAdded)
+	}
+	return nil
+}
+
+// ResumeRead restarts reading from the Conn paused by PauseRead.
+func (c *Conn) ResumeRead() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.readClosed {
+		return nil
+	}
+	if c.readPaused {
+		c.readPaused = false
+		if c.readDisabled() {
+			// resumed by splice or by the timer when the rate allows
+			return nil
+		}
+		return c.g.pollers[c.Hash()%len(c.g.pollers)].resumeRead(c.fd, c.isWAdded)
+	}
+	return nil
+}
+
+// setSplicePaused pauses or resumes reading for the backpressure of splice, apart from PauseRead,
+// the read events are waited for only if neither the application, splice nor the rate limits pause it.
+func (c *Conn) setSplicePaused(paused bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed || c.splicePaused == paused {
+		return
+	}
+	disabled := c.readDisabled()
+	c.splicePaused = paused
+	if disabled == c.readDisabled() {
+		return
+	}
+	p := c.g.pollers[c.Hash()%len(c.g.pollers)]
+	if paused {
+		p.pauseRead(c.fd, c.isWAdded)
+	} else {
+		p.resumeRead(c.fd, c.isWAdded)
+	}
+}
+
+// IsReadPaused returns whether the Conn's reading is paused.
+func (c *Conn) IsReadPaused() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.readPaused
+}
+
 func (c *Conn) modWrite() {
-	if !c.closed && !c.isWAdded {
+	if c.closed || c.throttleWrite() {
+		return
+	}
+	if !c.isWAdded {
 		c.isWAdded = true
-		c.g.pollers[c.Hash()%len(c.g.pollers)].modWrite(c.fd)
+		p := c.g.pollers[c.Hash()%len(c.g.pollers)]
+		if c.readDisabled() {
+			p.pauseRead(c.fd, true)
+		} else {
+			p.modWrite(c.fd)
+		}
 	}
 }
 
@@ -302,8 +589,12 @@ func (c *Conn) resetRead() {
 	if !c.closed && c.isWAdded {
 		c.isWAdded = false
 		p := c.g.pollers[c.Hash()%len(c.g.pollers)]
-		p.deleteEvent(c.fd)
-		p.addRead(c.fd)
+		if c.readDisabled() {
+			p.pauseRead(c.fd, false)
+		} else {
+			p.deleteEvent(c.fd)
+			p.addRead(c.fd)
+		}
 	}
 }
 
@@ -312,34 +603,62 @@ func (c *Conn) write(b []byte) (int, error) {
 		return 0, nil
 	}
 
+	if c.typ == connTypeUDPClientFromRead {
+		return c.writeUDP(b)
+	}
+
 	if c.overflow(len(b)) {
 		c.g.onWriteBufferFree(c, b)
 		return -1, syscall.EINVAL
 	}
 
 	if len(c.writeBuffers) == 0 {
-		n, err := syscall.Write(int(c.fd), b)
+		var n int
+		var err error
+		// b is released when the kernel notifies the completion if it's held by a send with MSG_ZEROCOPY
+		var held bool
+		wb := b
+		if q := c.writeQuota(); q < len(b) {
+			wb = b[:q]
+		}
+		zeroCopy := c.zeroCopy && len(wb) >= c.g.zeroCopyThreshold
+		switch {
+		case len(wb) == 0:
+			// throttled by the rate limits
+			err = syscall.EAGAIN
+		case zeroCopy:
+			n, held, err = c.sendZeroCopy(wb)
+		default:
+			n, err = syscall.Write(int(c.fd), wb)
+		}
 		if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
 			return n, err
 		}
+		if n < 0 {
+			n = 0
+		}
+		c.statsWrite(n)
+		c.writeConsumed(n)
 
 		left := len(b) - n
 		if left > 0 {
-			c.leftSize += left
+			c.setLeftSize(c.leftSize + left)
 			leftData := b
 			if n > 0 {
 				leftData = mempool.Malloc(left)
 				copy(leftData, b[n:])
-				c.g.onWriteBufferFree(c, b)
+				if !held {
+					c.g.onWriteBufferFree(c, b)
+				}
 			}
 			c.writeBuffers = append(c.writeBuffers, leftData)
 			c.modWrite()
-		} else {
+		} else if !held {
 			c.g.onWriteBufferFree(c, b)
 		}
 		return len(b), nil
 	}
-	c.leftSize += len(b)
+	c.setLeftSize(c.leftSize + len(b))
 	c.writeBuffers = append(c.writeBuffers, b)
 
 	return len(b), nil
@@ -354,6 +673,12 @@ func (c *Conn) flush() error {
 
 	buffers := c.writeBuffers
 	c.writeBuffers = nil
+	// the buffers queued after file segments are still left
+	size := 0
+	for _, b := range buffers {
+		size += len(b)
+	}
+	c.setLeftSize(c.leftSize - size)
 	var err error
 	switch len(buffers) {
 	case 1:
@@ -361,12 +686,17 @@ func (c *Conn) flush() error {
 	default:
 		_, err = c.writev(buffers)
 	}
+	var finished []*sendfileSegment
+	if err == nil && len(c.writeBuffers) == 0 && len(c.sendfiles) > 0 {
+		finished, err = c.flushSendfiles()
+	}
 	if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
 		c.closeWithErrorWithoutLock(err)
-		c.mux.Unlock()
+		c.unlock()
+		runSendfileDone(c, finished)
 		return err
 	}
-	if len(c.writeBuffers) == 0 {
+	if len(c.writeBuffers) == 0 && len(c.sendfiles) == 0 {
 		if c.wTimer != nil {
 			c.wTimer.Stop()
 		}
@@ -377,15 +707,27 @@ func (c *Conn) flush() error {
 			default:
 			}
 		}
+		if c.writeClosed {
+			c.shutdownWrite()
+		}
 	} else {
 		c.modWrite()
 	}
 
+	onWatermark := c.checkWatermark()
 	c.mux.Unlock()
+	runSendfileDone(c, finished)
+	if onWatermark != nil {
+		onWatermark()
+	}
 	return nil
 }
 
 func (c *Conn) writev(in [][]byte) (int, error) {
+	if c.typ == connTypeUDPClientFromRead {
+		return c.writevUDP(in)
+	}
+
 	size := 0
 	for _, v := range in {
 		size += len(v)
@@ -397,40 +739,144 @@ func (c *Conn) writev(in [][]byte) (int, error) {
 		return -1, syscall.EINVAL
 	}
 	if len(c.writeBuffers) > 0 {
+		c.setLeftSize(c.leftSize + size)
 		c.writeBuffers = append(c.writeBuffers, in...)
 		return size, nil
 	}
 
-	if len(in) > 1 && size <= 16384 {
-		var b []byte
-		if size < c.g.minConnCacheSize {
-			b = mempool.Malloc(c.g.minConnCacheSize)[:size]
-		} else {
-			b = mempool.Malloc(size)
+	// write at most maxIovecs buffers by a syscall, until all written, the kernel's sendQ is full or the rate limits reached
+	nwrite := 0
+	quota := c.writeQuota()
+	iovs := make([]syscall.Iovec, 0, len(in))
+	for len(in) > 0 && quota > 0 {
+		batch := 0
+		iovs = iovs[:0]
+		for _, b := range in {
+			if len(iovs) == maxIovecs || batch == quota {
+				break
+			}
+			if len(b) > 0 {
+				size := len(b)
+				if size > quota-batch {
+					size = quota - batch
+				}
+				iov := syscall.Iovec{Base: &b[0]}
+				iov.SetLen(size)
+				iovs = append(iovs, iov)
+				batch += size
+			}
 		}
-		copied := 0
-		for _, v := range in {
-			copy(b[copied:], v)
-			copied += len(v)
-			c.g.onWriteBufferFree(c, v)
+
+		var n int
+		var err error
+		if len(iovs) > 0 {
+			n, err = writev(c.fd, iovs)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil && err != syscall.EAGAIN {
+				for _, b := range in {
+					c.g.onWriteBufferFree(c, b)
+				}
+				return nwrite, err
+			}
+			if n < 0 {
+				n = 0
+			}
+			c.statsWrite(n)
+			c.writeConsumed(n)
+			nwrite += n
+			if quota != maxInt {
+				quota -= n
+			}
 		}
-		return c.write(b)
-	}
 
-	nwrite := 0
-	for i, b := range in {
-		n, err := c.write(b)
+		written := n
+		for len(in) > 0 && len(in[0]) <= n {
+			n -= len(in[0])
+			c.g.onWriteBufferFree(c, in[0])
+			in = in[1:]
+		}
 		if n > 0 {
-			nwrite += n
+			// copy the rest of the buffer partially written, as write does
+			left := mempool.Malloc(len(in[0]) - n)
+			copy(left, in[0][n:])
+			c.g.onWriteBufferFree(c, in[0])
+			c.writeBuffers = append(c.writeBuffers, left)
+			c.setLeftSize(c.leftSize + len(left))
+			in = in[1:]
+			break
 		}
-		if err != nil {
-			for j := i + 1; j < len(in); j++ {
-				c.g.onWriteBufferFree(c, in[j])
-			}
-			return nwrite, err
+		if written < batch {
+			break
+		}
+	}
+
+	if len(in) > 0 {
+		for _, b := range in {
+			c.setLeftSize(c.leftSize + len(b))
 		}
+		c.writeBuffers = append(c.writeBuffers, in...)
+	}
+	if len(c.writeBuffers) > 0 {
+		c.modWrite()
 	}
-	return nwrite, nil
+	return size, nil
+}
+
+// BufferedWriteSize returns the size of data cached by nbio which is waiting for the kernel's sendQ.
+func (c *Conn) BufferedWriteSize() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.leftSize
+}
+
+// SetWriteBufferWatermark sets the Conn's watermarks for OnWriteBufferHigh/OnWriteBufferLow,
+// which overrides the Gopher's config. high <= 0 disables the callbacks for the Conn.
+func (c *Conn) SetWriteBufferWatermark(high, low int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if high <= 0 {
+		high, low = -1, 0
+	}
+	if low < 0 || low >= high {
+		low = 0
+	}
+	c.wHighWatermark = high
+	c.wLowWatermark = low
+}
+
+// checkWatermark returns the callback to be called after c.mux is unlocked when a watermark is crossed.
+func (c *Conn) checkWatermark() func() {
+	if c.g == nil {
+		return nil
+	}
+	high, low := c.wHighWatermark, c.wLowWatermark
+	if high == 0 {
+		high, low = c.g.wHighWatermark, c.g.wLowWatermark
+	}
+	if high <= 0 && !c.wAboveHigh {
+		return nil
+	}
+
+	size := c.leftSize
+	if !c.wAboveHigh && size >= high {
+		c.wAboveHigh = true
+		return func() { c.g.onWriteBufferHigh(c, size) }
+	}
+	if c.wAboveHigh && size <= low {
+		c.wAboveHigh = false
+		return func() { c.g.onWriteBufferLow(c, size) }
+	}
+	return nil
+}
+
+// setLeftSize updates leftSize and the Gopher's pending write bytes.
+func (c *Conn) setLeftSize(n int) {
+	if c.g != nil && n != c.leftSize {
+		atomic.AddInt64(&c.g.stats.pendingWrite, int64(n-c.leftSize))
+	}
+	c.leftSize = n
 }
 
 func (c *Conn) overflow(n int) bool {
@@ -441,13 +887,22 @@ func (c *Conn) closeWithError(err error) error {
 	c.mux.Lock()
 	if !c.closed {
 		err = c.closeWithErrorWithoutLock(err)
-		c.mux.Unlock()
+		c.unlock()
 		return err
 	}
 	c.mux.Unlock()
 	return nil
 }
 
+// closeIdle closes the Conn with ErrIdleTimeout if it's an idle tcp or unix Conn, dialing Conns are not swept.
+func (c *Conn) closeIdle(now int64) {
+	c.mux.Lock()
+	if !c.closed && (c.typ == connTypeTCP || c.typ == connTypeUnix) && c.dialer == nil && c.isIdle(now) {
+		c.closeWithErrorWithoutLock(ErrIdleTimeout)
+	}
+	c.unlock()
+}
+
 func (c *Conn) closeWithErrorWithoutLock(err error) error {
 	c.closed = true
 
@@ -461,11 +916,35 @@ func (c *Conn) closeWithErrorWithoutLock(err error) error {
 		c.rTimer.Stop()
 		c.rTimer = nil
 	}
+	if c.proxy != nil && c.proxy.timer != nil {
+		c.proxy.timer.Stop()
+	}
+	if c.rThrottle != nil {
+		c.rThrottle.Stop()
+		c.rThrottle = nil
+	}
+	if c.wThrottle != nil {
+		c.wThrottle.Stop()
+		c.wThrottle = nil
+	}
 
 	for _, b := range c.writeBuffers {
 		mempool.Free(b)
 	}
 	c.writeBuffers = nil
+	c.closeSendfiles(err)
+	c.setLeftSize(0)
+
+	// the kernel may still be sending the buffers after the socket is closed,
+	// they are left to the gc instead of being released for reusing.
+	c.zcPending = nil
+
+	if c.spliceTo != nil {
+		c.spliceTo.closed(c, err)
+	}
+	if c.spliceFrom != nil {
+		c.spliceFrom.closed(c, err)
+	}
 
 	if c.chWaitWrite != nil {
 		select {
@@ -474,6 +953,18 @@ func (c *Conn) closeWithErrorWithoutLock(err error) error {
 		}
 	}
 
+	if c.dialer != nil {
+		return c.closeDialing(err)
+	}
+
+	switch c.typ {
+	case connTypeUDPServer:
+		c.closeUDPClients(err)
+	case connTypeUDPClientFromRead:
+		c.closeUDPClient()
+		return nil
+	}
+
 	if c.g != nil {
 		c.g.pollers[c.Hash()%len(c.g.pollers)].deleteConn(c)
 	}
@@ -0,0 +1,30 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package nbio
+
+import (
+	"net"
+	"time"
+)
+
+// DialAsync connects to the address in a new goroutine, h is called after the connection is established or failed.
+// OnOpen is called before h when connected.
+func (g *Gopher) DialAsync(network, addr string, timeout time.Duration, h func(c *Conn, err error)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+
+	go func() {
+		conn, err := net.DialTimeout(network, addr, timeout)
+		if err != nil {
+			h(nil, err)
+			return
+		}
+		c, err := g.AddConn(conn)
+		h(c, err)
+	}()
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type dialer struct {
+	h     func(c *Conn, err error)
+	timer *htimer
+}
+
+// DialAsync connects to the address without blocking, the socket is registered to a poller and
+// h is called after the connection is established or failed. if timeout > 0, the connecting is
+// canceled with a timeout error when it's not finished in time.
+// OnOpen is called before h when connected. h is called in a poller goroutine or the timer goroutine,
+// or before DialAsync returns if the dialing fails immediately.
+// the address is resolved synchronously, use an ip address to avoid dns blocking.
+func (g *Gopher) DialAsync(network, addr string, timeout time.Duration, h func(c *Conn, err error)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+
+	sa, soType, rAddr, err := getDialSockaddr(network, addr)
+	if err != nil {
+		h(nil, err)
+		return
+	}
+
+	proto := syscall.IPPROTO_TCP
+	if soType == syscall.AF_UNIX {
+		proto = 0
+	}
+
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(soType, syscall.SOCK_STREAM, proto)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		h(nil, err)
+		return
+	}
+
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		h(nil, err)
+		return
+	}
+
+	err = syscall.Connect(fd, sa)
+	if err != nil && err != syscall.EINPROGRESS && err != syscall.EINTR {
+		syscall.Close(fd)
+		h(nil, err)
+		return
+	}
+
+	c := newConn(fd, nil, rAddr)
+	c.g = g
+	c.statsOpen()
+	if soType == syscall.AF_UNIX {
+		c.typ = connTypeUnix
+	}
+	c.initRateLimit()
+	c.dialer = &dialer{h: h}
+
+	c.mux.Lock()
+	if timeout > 0 {
+		c.dialer.timer = c.afterFunc(timeout, func() { c.closeWithError(errTimeout) })
+	}
+	p := g.pollers[c.Hash()%len(g.pollers)]
+	g.connsUnix[fd] = c
+	err = p.addWrite(fd)
+	if err != nil {
+		c.closeWithErrorWithoutLock(err)
+	}
+	c.unlock()
+}
+
+// finishDial is called by the poller when the dialing socket is writable or failed.
+func (c *Conn) finishDial(p *poller) {
+	c.mux.Lock()
+	if c.closed || c.dialer == nil {
+		c.mux.Unlock()
+		return
+	}
+
+	errno, err := syscall.GetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err == nil && errno != 0 {
+		err = syscall.Errno(errno)
+	}
+	if err == nil {
+		err = p.modRead(c.fd)
+	}
+	if err != nil {
+		c.closeWithErrorWithoutLock(err)
+		c.unlock()
+		return
+	}
+
+	d := c.dialer
+	c.dialer = nil
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if sa, err := syscall.Getsockname(c.fd); err == nil {
+		c.lAddr = sockaddrToAddr(sa)
+	}
+	c.mux.Unlock()
+
+	atomic.AddInt64(&p.online, 1)
+	c.g.onOpen(c)
+	d.h(c, nil)
+}
+
+// closeDialing cleans a dialing Conn without OnClose, because OnOpen has not been called.
+func (c *Conn) closeDialing(err error) error {
+	d := c.dialer
+	c.dialer = nil
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	fd := c.fd
+	if c.g.connsUnix[fd] == c {
+		c.g.connsUnix[fd] = nil
+		c.g.pollers[c.Hash()%len(c.g.pollers)].deleteEvent(fd)
+	}
+	closeErr := syscall.Close(fd)
+
+	if err == nil {
+		err = errClosed
+	}
+	d.h(nil, err)
+
+	return closeErr
+}
+
+func getDialSockaddr(network, addr string) (syscall.Sockaddr, int, net.Addr, error) {
+	if isUnixNetwork(network) {
+		return &syscall.SockaddrUnix{Name: addr}, syscall.AF_UNIX, &net.UnixAddr{Net: network, Name: addr}, nil
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, -1, nil, errors.New("unsupported protocol")
+	}
+
+	tcp, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, -1, nil, err
+	}
+
+	if len(tcp.IP) == 0 {
+		if network == "tcp6" {
+			tcp.IP = net.IPv6loopback
+		} else {
+			tcp.IP = net.IPv4(127, 0, 0, 1)
+		}
+	}
+
+	if ip4 := tcp.IP.To4(); ip4 != nil && network != "tcp6" {
+		sa := &syscall.SockaddrInet4{Port: tcp.Port}
+		copy(sa.Addr[:], ip4)
+		return sa, syscall.AF_INET, tcp, nil
+	}
+
+	if network == "tcp4" {
+		return nil, -1, nil, errors.New("invalid addr: " + addr)
+	}
+
+	sa := &syscall.SockaddrInet6{Port: tcp.Port}
+	copy(sa.Addr[:], tcp.IP.To16())
+	if tcp.Zone != "" {
+		iface, err := net.InterfaceByName(tcp.Zone)
+		if err != nil {
+			return nil, -1, nil, err
+		}
+		sa.ZoneId = uint32(iface.Index)
+	}
+	return sa, syscall.AF_INET6, tcp, nil
+}
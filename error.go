@@ -11,8 +11,14 @@ import (
 var (
 	errClosed       = errors.New("conn closed")
 	errInvalidData  = errors.New("invalid data")
+	errInvalidFile  = errors.New("invalid file")
 	errWriteWaiting = errors.New("write waiting")
 	errTimeout      = errors.New("timeout")
 	errReadTimeout  = errors.New("read timeout")
 	errWriteTimeout = errors.New("write timeout")
+	errWriteClosed  = errors.New("write closed")
+	errHandoff      = errors.New("handed off to another process")
 )
+
+// ErrIdleTimeout is passed to OnClose for a Conn closed by the idle sweeper.
+var ErrIdleTimeout = errors.New("idle timeout")
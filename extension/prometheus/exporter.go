@@ -0,0 +1,282 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package prometheus
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/mempool"
+	"github.com/lesismal/nbio/nbhttp"
+	"github.com/lesismal/nbio/taskpool"
+)
+
+// DefaultNamespace is the prefix of metric names.
+const DefaultNamespace = "nbio"
+
+// ContentType is the content type of prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// TaskPool represents the pools of package taskpool.
+type TaskPool interface {
+	Stats() taskpool.Stats
+}
+
+type namedPool struct {
+	name string
+	pool TaskPool
+}
+
+// Exporter renders the metrics of Gophers, nbhttp.Servers, task pools and mempool
+// in prometheus text exposition format, it implements http.Handler.
+type Exporter struct {
+	mux sync.Mutex
+
+	namespace string
+	gophers   []*nbio.Gopher
+	servers   []*nbhttp.Server
+	pools     []namedPool
+}
+
+// AddGopher adds a Gopher to export, labeled by its Name.
+func (e *Exporter) AddGopher(g *nbio.Gopher) {
+	e.mux.Lock()
+	e.gophers = append(e.gophers, g)
+	e.mux.Unlock()
+}
+
+// AddServer adds a nbhttp.Server and its Gopher to export, labeled by its Name.
+func (e *Exporter) AddServer(s *nbhttp.Server) {
+	e.mux.Lock()
+	e.gophers = append(e.gophers, s.Gopher)
+	e.servers = append(e.servers, s)
+	e.mux.Unlock()
+}
+
+// AddTaskPool adds a task pool to export, labeled by name.
+func (e *Exporter) AddTaskPool(name string, p TaskPool) {
+	e.mux.Lock()
+	e.pools = append(e.pools, namedPool{name: name, pool: p})
+	e.mux.Unlock()
+}
+
+// ServeHTTP implements http.Handler.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	e.WriteTo(buf)
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// WriteTo writes all metrics to w.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mux.Lock()
+	gophers := append([]*nbio.Gopher{}, e.gophers...)
+	servers := append([]*nbhttp.Server{}, e.servers...)
+	pools := append([]namedPool{}, e.pools...)
+	e.mux.Unlock()
+
+	m := &metricWriter{namespace: e.namespace}
+
+	gStats := make([]*nbio.GopherStats, len(gophers))
+	for i, g := range gophers {
+		gStats[i] = g.Stats()
+	}
+	sStats := make([]*nbhttp.ServerStats, len(servers))
+	for i, s := range servers {
+		sStats[i] = s.HTTPStats()
+		if sStats[i].MessageHandlerPool != nil {
+			pools = append(pools, namedPool{name: s.Name + "_message_handler", pool: staticPool(*sStats[i].MessageHandlerPool)})
+		}
+	}
+
+	m.family("conns", "gauge", "Conns added to pollers.")
+	for _, s := range gStats {
+		m.sample("conns", float64(s.Online), "gopher", s.Name)
+	}
+	m.family("poller_conns", "gauge", "Conns of each poller.")
+	for _, s := range gStats {
+		for i, n := range s.PollerConns {
+			m.sample("poller_conns", float64(n), "gopher", s.Name, "poller", strconv.Itoa(i))
+		}
+	}
+	m.family("accepted_total", "counter", "Conns accepted by listeners.")
+	for _, s := range gStats {
+		m.sample("accepted_total", float64(s.Accepted), "gopher", s.Name)
+	}
+	m.family("rejected_total", "counter", "Conns rejected by acceptors.")
+	for _, s := range gStats {
+		m.sample("rejected_total", float64(s.Rejected), "gopher", s.Name)
+	}
+	m.family("closed_total", "counter", "Conns closed by reason.")
+	for _, s := range gStats {
+		for _, reason := range sortedKeys(s.ClosedByReason) {
+			m.sample("closed_total", float64(s.ClosedByReason[reason]), "gopher", s.Name, "reason", reason)
+		}
+	}
+	m.family("read_bytes_total", "counter", "Bytes read from conns.")
+	for _, s := range gStats {
+		m.sample("read_bytes_total", float64(s.BytesRead), "gopher", s.Name)
+	}
+	m.family("written_bytes_total", "counter", "Bytes written to conns.")
+	for _, s := range gStats {
+		m.sample("written_bytes_total", float64(s.BytesWritten), "gopher", s.Name)
+	}
+	m.family("pending_write_bytes", "gauge", "Bytes cached by nbio waiting for the kernel's send queue.")
+	for _, s := range gStats {
+		m.sample("pending_write_bytes", float64(s.PendingWriteBytes), "gopher", s.Name)
+	}
+	m.family("timers", "gauge", "Timers outstanding.")
+	for _, s := range gStats {
+		m.sample("timers", float64(s.Timers), "gopher", s.Name)
+	}
+
+	mallocNum, mallocSize, freeNum, freeSize, _ := mempool.State()
+	m.family("mempool_malloc_total", "counter", "Buffers allocated by mempool.")
+	m.sample("mempool_malloc_total", float64(mallocNum))
+	m.family("mempool_malloc_bytes_total", "counter", "Bytes allocated by mempool.")
+	m.sample("mempool_malloc_bytes_total", float64(mallocSize))
+	m.family("mempool_free_total", "counter", "Buffers freed to mempool.")
+	m.sample("mempool_free_total", float64(freeNum))
+	m.family("mempool_free_bytes_total", "counter", "Bytes freed to mempool.")
+	m.sample("mempool_free_bytes_total", float64(freeSize))
+
+	m.family("taskpool_workers", "gauge", "Goroutines of task pools.")
+	for _, p := range pools {
+		m.sample("taskpool_workers", float64(p.pool.Stats().Workers), "pool", p.name)
+	}
+	m.family("taskpool_queued_tasks", "gauge", "Tasks waiting for a worker.")
+	for _, p := range pools {
+		m.sample("taskpool_queued_tasks", float64(p.pool.Stats().Queued), "pool", p.name)
+	}
+
+	m.family("http_conns", "gauge", "Conns of http servers.")
+	for i, s := range sStats {
+		m.sample("http_conns", float64(s.Online), "server", servers[i].Name)
+	}
+	m.family("http_responses_total", "counter", "Http responses by status code.")
+	for i, s := range sStats {
+		for _, code := range sortedCodes(s.StatusCodes) {
+			m.sample("http_responses_total", float64(s.StatusCodes[code]), "server", servers[i].Name, "code", strconv.Itoa(code))
+		}
+	}
+	m.family("http_request_duration_seconds", "histogram", "Time from a request parsed to its response flushed.")
+	for i, s := range sStats {
+		m.histogram("http_request_duration_seconds", s.Latency, "server", servers[i].Name)
+	}
+	m.family("http_pending_requests", "gauge", "Requests waiting for the message handler or being handled.")
+	for i, s := range sStats {
+		m.sample("http_pending_requests", float64(s.PendingRequests), "server", servers[i].Name)
+	}
+	m.family("websocket_messages_total", "counter", "Websocket text and binary messages.")
+	for i, s := range sStats {
+		m.sample("websocket_messages_total", float64(s.WebsocketMessagesRead), "server", servers[i].Name, "direction", "read")
+		m.sample("websocket_messages_total", float64(s.WebsocketMessagesWritten), "server", servers[i].Name, "direction", "write")
+	}
+
+	n, err := w.Write(m.buf.Bytes())
+	return int64(n), err
+}
+
+type staticPool taskpool.Stats
+
+func (p staticPool) Stats() taskpool.Stats {
+	return taskpool.Stats(p)
+}
+
+type metricWriter struct {
+	namespace string
+	buf       bytes.Buffer
+}
+
+func (m *metricWriter) name(name string) string {
+	if m.namespace == "" {
+		return name
+	}
+	return m.namespace + "_" + name
+}
+
+func (m *metricWriter) family(name, typ, help string) {
+	name = m.name(name)
+	m.buf.WriteString("# HELP " + name + " " + help + "\n")
+	m.buf.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes a line, labels are pairs of name and value.
+func (m *metricWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(m.name(name))
+	if len(labels) > 0 {
+		m.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteByte(',')
+			}
+			m.buf.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		m.buf.WriteByte('}')
+	}
+	m.buf.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func (m *metricWriter) histogram(name string, h nbhttp.HistogramSnapshot, labels ...string) {
+	for i, le := range h.Buckets {
+		m.sample(name+"_bucket", float64(h.Counts[i]), append(labels, "le", formatFloat(le))...)
+	}
+	m.sample(name+"_bucket", float64(h.Count), append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", h.Sum, labels...)
+	m.sample(name+"_count", float64(h.Count), labels...)
+}
+
+// New creates an Exporter, namespace is set to DefaultNamespace if it's empty.
+func New(namespace string) *Exporter {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &Exporter{namespace: namespace}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCodes(m map[int]uint64) []int {
+	codes := make([]int, 0, len(m))
+	for k := range m {
+		codes = append(codes, k)
+	}
+	sort.Ints(codes)
+	return codes
+}
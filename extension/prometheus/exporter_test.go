@@ -0,0 +1,74 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lesismal/nbio/nbhttp"
+	"github.com/lesismal/nbio/taskpool"
+)
+
+func TestExporter(t *testing.T) {
+	addr := "127.0.0.1:8898"
+	exporter := New("")
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/metrics", exporter)
+
+	svr := nbhttp.NewServer(nbhttp.Config{
+		Name:    "test",
+		Network: "tcp",
+		Addrs:   []string{addr},
+	}, mux, nil)
+	err := svr.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer svr.Stop()
+
+	pool := taskpool.NewFixedPool(2, 16)
+	defer pool.Stop()
+	exporter.AddServer(svr)
+	exporter.AddTaskPool("fixed", pool)
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		log.Panicf("Get failed: %v", err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		log.Panicf("Get metrics failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		log.Panicf("read metrics failed: %v", err)
+	}
+	if res.Header.Get("Content-Type") != ContentType {
+		log.Panicf("invalid content type: %v", res.Header.Get("Content-Type"))
+	}
+
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE nbio_conns gauge",
+		`nbio_accepted_total{gopher="test"} `,
+		`nbio_http_responses_total{server="test",code="200"} `,
+		`nbio_http_request_duration_seconds_bucket{server="test",le="+Inf"} `,
+		`nbio_http_request_duration_seconds_count{server="test"} `,
+		`nbio_taskpool_workers{pool="fixed"} 2`,
+		`nbio_taskpool_workers{pool="test_message_handler"} `,
+		`nbio_websocket_messages_total{server="test",direction="read"} 0`,
+		"nbio_mempool_malloc_total ",
+	} {
+		if !strings.Contains(text, line) {
+			log.Panicf("metric not found: %v\n%v", line, text)
+		}
+	}
+}
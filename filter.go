@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrDenied is passed to OnReject for a conn rejected by the CIDR filter or OnAccept.
+var ErrDenied = errors.New("denied")
+
+// cidrFilter is immutable, it's replaced as a whole by SetCIDRFilter.
+type cidrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid ip: " + s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept returns whether the remote addr passes the filter, non-ip addrs always pass.
+func (f *cidrFilter) accept(remote net.Addr) bool {
+	if f == nil || (len(f.allow) == 0 && len(f.deny) == 0) {
+		return true
+	}
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// SetCIDRFilter replaces the CIDR lists checked by the acceptor, it's safe to be called at runtime.
+// a conn from an ip in deny is rejected, and if allow is not empty, a conn from an ip not in allow is rejected.
+// an entry is a CIDR like "10.0.0.0/8" or a single ip, both lists empty disables it.
+// the conns accepted before are not affected, and unix conns are not filtered.
+func (g *Gopher) SetCIDRFilter(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	g.cidrFilter.Store(&cidrFilter{allow: allowNets, deny: denyNets})
+	return nil
+}
+
+// accept checks the CIDR filter and OnAccept for a conn accepted.
+func (g *Gopher) accept(remote net.Addr) bool {
+	f, _ := g.cidrFilter.Load().(*cidrFilter)
+	return f.accept(remote) && g.onAccept(remote)
+}
@@ -6,9 +6,11 @@ package nbio
 
 import (
 	"container/heap"
+	"io"
 	"net"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lesismal/nbio/logging"
@@ -23,6 +25,18 @@ const (
 
 	// DefaultMinConnCacheSize .
 	DefaultMinConnCacheSize = 1024 * 2
+
+	// DefaultUDPReadTimeout .
+	DefaultUDPReadTimeout = time.Second * 120
+
+	// DefaultHandoffTimeout .
+	DefaultHandoffTimeout = time.Second * 10
+
+	// DefaultTimerWheelTick .
+	DefaultTimerWheelTick = time.Millisecond * 10
+
+	// DefaultProxyProtocolTimeout .
+	DefaultProxyProtocolTimeout = time.Second * 5
 )
 
 var (
@@ -36,8 +50,8 @@ type Config struct {
 	Name string
 
 	// Network is the listening protocol, used with Addrs toghter.
-	// tcp* supported only by now, there's no plan for other protocol such as udp,
-	// because it's too easy to write udp server/client.
+	// tcp*, udp* and unix are supported, udp* is not supported on windows.
+	// for unix, an addr with prefix "@" represents an abstract socket on linux.
 	Network string
 
 	// Addrs is the listening addr list for a nbio server.
@@ -47,9 +61,15 @@ type Config struct {
 	// NPoller represents poller goroutine num, it's set to runtime.NumCPU() by default.
 	NPoller int
 
-	// NListener represents poller goroutine num, it's set to runtime.NumCPU() by default.
+	// NListener represents listener num for each addr, it works with ReusePort only.
+	// it's set to NPoller by default if ReusePort is true, else 1.
 	NListener int
 
+	// ReusePort represents whether to bind NListener sockets with SO_REUSEPORT for each addr,
+	// each socket has its own acceptor goroutine and the kernel balances new connections between them.
+	// for udp, each socket is added to a poller. it's not supported for unix and on windows.
+	ReusePort bool
+
 	// Backlog represents backlog arg for syscall.Listen
 	Backlog int
 
@@ -64,11 +84,144 @@ type Config struct {
 	// more than MaxWriteBufferSize, the connection would be closed by nbio.
 	MaxWriteBufferSize int
 
+	// WriteBufferHighWatermark represents the buffered write size of a Conn to call OnWriteBufferHigh,
+	// it's set to 0 by default, which disables OnWriteBufferHigh/OnWriteBufferLow.
+	WriteBufferHighWatermark int
+
+	// WriteBufferLowWatermark represents the buffered write size of a Conn to call OnWriteBufferLow
+	// after OnWriteBufferHigh has been called, it's set to 0 by default.
+	WriteBufferLowWatermark int
+
+	// ZeroCopyThreshold represents the min size of a buffer to be sent with MSG_ZEROCOPY by Conn.Write on linux,
+	// such a buffer is passed to OnWriteBufferRelease after the kernel notifies the completion instead of after
+	// the syscall, so it must not be modified until then. it works only for tcp Conns and the buffers written
+	// when nothing is cached by nbio. it's set to 0 by default, which disables it.
+	ZeroCopyThreshold int
+
 	// LockListener represents listener's goroutine to lock thread or not, it's set to false by default.
 	LockListener bool
 
 	// LockPoller represents poller's goroutine to lock thread or not, it's set to false by default.
 	LockPoller bool
+
+	// UDPVirtualConn represents whether to create a virtual Conn for each remote addr of a udp listener.
+	// if true, OnOpen/OnClose are called for each remote addr, and the virtual Conn is closed after UDPReadTimeout idle time;
+	// else OnData is called with a temporary Conn for each datagram, which is only valid during OnData.
+	// Conn.RemoteAddr returns the remote addr and Conn.Write sends a datagram to it in both cases.
+	UDPVirtualConn bool
+
+	// UDPReadTimeout represents the idle time for udp virtual Conn, it's set to 120s by default.
+	UDPReadTimeout time.Duration
+
+	// HandoffPath represents the unix socket path to receive listeners and conns from a running process
+	// which calls Gopher.ServeHandoff with the same path, Addrs and ReusePort are ignored if it's set.
+	// Start waits for the handoff for DefaultHandoffTimeout at most. it's not supported on windows.
+	HandoffPath string
+
+	// Listeners represents listeners opened by the caller, they are served by listener pollers as if nbio created them,
+	// Addrs and ReusePort are ignored if any inherited socket is set or found.
+	Listeners []net.Listener
+
+	// ListenerFds represents inherited socket fds, which are owned and closed by the Gopher after Start.
+	// listening stream sockets are served by listener pollers, datagram sockets as udp listeners,
+	// and connected stream sockets as Conns. it's not supported on windows.
+	ListenerFds []int
+
+	// SystemdSocketActivation represents whether to adopt the sockets passed by systemd with
+	// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, Addrs is used if the process is not socket activated.
+	// it's not supported on windows.
+	SystemdSocketActivation bool
+
+	// SystemdFdNames represents the names in LISTEN_FDNAMES to adopt, all sockets are adopted if it's empty.
+	SystemdFdNames []string
+
+	// TimerWheel represents whether to use hierarchical timing wheels instead of the timer heap for deadlines and AfterFunc,
+	// there is a timing wheel for each poller, a Conn's deadline timers are added to its poller's timing wheel,
+	// and other timers are added to the timing wheels in turn. it's set to false by default.
+	TimerWheel bool
+
+	// TimerWheelTick represents the tick of timing wheels, timers fire no earlier than their expire
+	// and at most about a tick later. it's set to 10ms by default.
+	TimerWheelTick time.Duration
+
+	// IdleTimeout represents the time to close a Conn with ErrIdleTimeout if nothing is read or written,
+	// a sweeper of each poller checks its conns every IdleTimeout/10, bounded by 100ms and 1s, on the poller's goroutine.
+	// it can be overridden by Conn.SetIdleTimeout, udp Conns are not swept. it's set to 0 by default, which disables it.
+	IdleTimeout time.Duration
+
+	// MaxConnsPerIP represents the max num of concurrent conns accepted from a source ip, or a source prefix
+	// of IPv4PrefixLen/IPv6PrefixLen, more conns are rejected. it's set to 0 by default, which disables it.
+	MaxConnsPerIP int
+
+	// AcceptRate represents the num of conns accepted per second by all listeners of the Gopher,
+	// with bursts of AcceptBurst, more conns are rejected. it's set to 0 by default, which disables it.
+	AcceptRate float64
+
+	// AcceptBurst represents the burst of AcceptRate, it's set to AcceptRate by default, and 1 at least.
+	AcceptBurst int
+
+	// AcceptRatePerIP represents the num of conns accepted per second from a source ip or prefix,
+	// with bursts of AcceptBurstPerIP, more conns are rejected. it's set to 0 by default, which disables it.
+	AcceptRatePerIP float64
+
+	// AcceptBurstPerIP represents the burst of AcceptRatePerIP, it's set to AcceptRatePerIP by default, and 1 at least.
+	AcceptBurstPerIP int
+
+	// IPv4PrefixLen represents the prefix length to group ipv4 sources for MaxConnsPerIP and AcceptRatePerIP,
+	// it's set to 32 by default.
+	IPv4PrefixLen int
+
+	// IPv6PrefixLen represents the prefix length to group ipv6 sources for MaxConnsPerIP and AcceptRatePerIP,
+	// it's set to 128 by default.
+	IPv6PrefixLen int
+
+	// AllowCIDRs represents the CIDRs or ips to accept conns from, conns from others are rejected with ErrDenied.
+	// it's empty by default, which accepts all. it can be replaced at runtime by Gopher.SetCIDRFilter.
+	AllowCIDRs []string
+
+	// DenyCIDRs represents the CIDRs or ips to reject conns from with ErrDenied, which overrides AllowCIDRs.
+	// it can be replaced at runtime by Gopher.SetCIDRFilter.
+	DenyCIDRs []string
+
+	// ProxyProtocol represents whether the conns accepted begin with a PROXY protocol v1 or v2 header, which is
+	// consumed before OnOpen, then Conn.RemoteAddr/LocalAddr return the addrs in it and Conn.ProxyHeader returns it.
+	// a conn without a valid header is closed without OnOpen/OnClose. the filters and the admission control above
+	// apply to the addr of the proxy. it's set to false by default.
+	ProxyProtocol bool
+
+	// ProxyProtocolTimeout represents the time to wait for the PROXY protocol header of a conn accepted, it's set to 5s by default.
+	ProxyProtocolTimeout time.Duration
+
+	// ConnReadRate represents the max bytes per second read from a Conn, with bursts of ConnReadBurst.
+	// the reading of a Conn reaching it is paused until the rate allows. it can be overridden by Conn.SetRateLimit,
+	// it's for tcp and unix Conns only. it's set to 0 by default, which disables it.
+	ConnReadRate int
+
+	// ConnReadBurst represents the burst of ConnReadRate, it's set to ConnReadRate by default.
+	ConnReadBurst int
+
+	// ConnWriteRate represents the max bytes per second written to a Conn, with bursts of ConnWriteBurst.
+	// the data written more is cached, and flushed by a timer when the rate allows, which counts for
+	// MaxWriteBufferSize. it can be overridden by Conn.SetRateLimit, it's for tcp and unix Conns only,
+	// and not for SpliceTo. it's set to 0 by default, which disables it.
+	ConnWriteRate int
+
+	// ConnWriteBurst represents the burst of ConnWriteRate, it's set to ConnWriteRate by default.
+	ConnWriteBurst int
+
+	// ReadRate represents the max bytes per second read from all Conns of the Gopher, with bursts of ReadBurst,
+	// it works as ConnReadRate. it's set to 0 by default, which disables it.
+	ReadRate int
+
+	// ReadBurst represents the burst of ReadRate, it's set to ReadRate by default.
+	ReadBurst int
+
+	// WriteRate represents the max bytes per second written to all Conns of the Gopher, with bursts of WriteBurst,
+	// it works as ConnWriteRate. it's set to 0 by default, which disables it.
+	WriteRate int
+
+	// WriteBurst represents the burst of WriteRate, it's set to WriteRate by default.
+	WriteBurst int
 }
 
 // Gopher is a manager of poller
@@ -82,27 +235,50 @@ type Gopher struct {
 	network            string
 	addrs              []string
 	pollerNum          int
+	listenerNum        int
+	reusePort          bool
 	backlogSize        int
 	readBufferSize     int
 	maxWriteBufferSize int
 	minConnCacheSize   int
+	wHighWatermark     int
+	wLowWatermark      int
+	zeroCopyThreshold  int
 	lockListener       bool
 	lockPoller         bool
+	udpVirtualConn     bool
+	udpReadTimeout     time.Duration
+	handoffPath        string
+	inheritedListeners []net.Listener
+	listenerFds        []int
+	systemdActivation  bool
+	systemdFdNames     []string
 
 	lfds []int
 
 	connsStd  map[*Conn]struct{}
 	connsUnix []*Conn
 
+	reconns map[*ReconnectConn]struct{}
+
 	listeners []*poller
 	pollers   []*poller
 
+	stats *gopherStats
+
 	onOpen            func(c *Conn)
 	onClose           func(c *Conn, err error)
 	onData            func(c *Conn, data []byte)
 	onReadBufferAlloc func(c *Conn) []byte
 	onReadBufferFree  func(c *Conn, buffer []byte)
 	onWriteBufferFree func(c *Conn, buffer []byte)
+	onWriteBufferHigh func(c *Conn, size int)
+	onWriteBufferLow  func(c *Conn, size int)
+	onReadTimeout     func(c *Conn)
+	onWriteTimeout    func(c *Conn)
+	onHalfClose       func(c *Conn)
+	onAccept          func(remote net.Addr) bool
+	onReject          func(conn net.Conn, err error)
 	beforeRead        func(c *Conn)
 	afterRead         func(c *Conn)
 	beforeWrite       func(c *Conn)
@@ -111,6 +287,26 @@ type Gopher struct {
 	timers  timerHeap
 	trigger *time.Timer
 	chTimer chan struct{}
+
+	wheels     []*timingWheel
+	wheelIndex uint32
+
+	idleTimeout time.Duration
+	idleOnce    sync.Once
+
+	admission  *admission
+	cidrFilter atomic.Value
+	filterErr  error
+
+	proxyProtocol        bool
+	proxyProtocolTimeout time.Duration
+
+	connReadRate   int
+	connReadBurst  int
+	connWriteRate  int
+	connWriteBurst int
+	readLimiter    *rateLimiter
+	writeLimiter   *rateLimiter
 }
 
 // Stop pollers
@@ -130,8 +326,14 @@ func (g *Gopher) Stop() {
 	conns := g.connsStd
 	g.connsStd = map[*Conn]struct{}{}
 	connsUnix := g.connsUnix
+	reconns := g.reconns
+	g.reconns = nil
 	g.mux.Unlock()
 
+	for rc := range reconns {
+		rc.stop()
+	}
+
 	for c := range conns {
 		if c != nil {
 			c.Close()
@@ -205,6 +407,73 @@ func (g *Gopher) OnWriteBufferRelease(h func(c *Conn, b []byte)) {
 	g.onWriteBufferFree = h
 }
 
+// OnWriteBufferHigh registers callback for a Conn's buffered write size reaching the high watermark,
+// the handler is called without the Conn's lock, size is the buffered write size.
+func (g *Gopher) OnWriteBufferHigh(h func(c *Conn, size int)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onWriteBufferHigh = h
+}
+
+// OnWriteBufferLow registers callback for a Conn's buffered write size dropping to the low watermark
+// after OnWriteBufferHigh has been called, the handler is called without the Conn's lock.
+func (g *Gopher) OnWriteBufferLow(h func(c *Conn, size int)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onWriteBufferLow = h
+}
+
+// OnReadTimeout registers callback for a Conn's read deadline, which is called instead of closing the Conn.
+// the deadline is cleared before the handler is called, the handler may close the Conn, set a new deadline or write a probe.
+// it's set to close the Conn with a read timeout error by default. udp virtual Conns are still closed for UDPReadTimeout.
+func (g *Gopher) OnReadTimeout(h func(c *Conn)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onReadTimeout = h
+}
+
+// OnWriteTimeout registers callback for a Conn's write deadline, which is called instead of closing the Conn.
+// the deadline is cleared before the handler is called, the data buffered is kept.
+// it's set to close the Conn with a write timeout error by default.
+func (g *Gopher) OnWriteTimeout(h func(c *Conn)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onWriteTimeout = h
+}
+
+// OnHalfClose registers callback for the peer's shutting down its writing side, which is called instead of closing the Conn.
+// the handler may keep writing, and then call Close or CloseWrite. reading is stopped after the handler returns.
+// it's set to close the Conn with io.EOF by default.
+func (g *Gopher) OnHalfClose(h func(c *Conn)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onHalfClose = h
+}
+
+// OnAccept registers the predicate for a conn accepted, which is called in the acceptor goroutine after the CIDR filter
+// passes, the conn is rejected with ErrDenied before it's added to a poller if it returns false. it accepts all by default.
+func (g *Gopher) OnAccept(h func(remote net.Addr) bool) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onAccept = h
+}
+
+// OnReject registers callback for a conn rejected by the acceptor, which is called in the acceptor goroutine
+// before the conn is added to a poller, and the conn is closed after it returns.
+// err is ErrDenied, ErrTooManyConns or ErrAcceptRate. it does nothing by default.
+func (g *Gopher) OnReject(h func(conn net.Conn, err error)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	g.onReject = h
+}
+
 // BeforeRead registers callback before syscall.Read
 // the handler would be called on windows
 func (g *Gopher) BeforeRead(h func(c *Conn)) {
@@ -256,6 +525,10 @@ func (g *Gopher) AfterFunc(timeout time.Duration, f func()) *Timer {
 }
 
 func (g *Gopher) afterFunc(timeout time.Duration, f func()) *htimer {
+	if len(g.wheels) > 0 {
+		return g.afterFuncShard(atomic.AddUint32(&g.wheelIndex, 1), timeout, f)
+	}
+
 	g.tmux.Lock()
 	defer g.tmux.Unlock()
 
@@ -331,17 +604,7 @@ func (g *Gopher) timerLoop() {
 				if now.After(it.expire) {
 					heap.Remove(&g.timers, it.index)
 					g.tmux.Unlock()
-					func() {
-						defer func() {
-							err := recover()
-							if err != nil {
-								logging.Error("Gopher[%v] exec timer failed: %v", g.Name, err)
-								debug.PrintStack()
-							}
-						}()
-						it.f()
-					}()
-
+					g.execTimer(it.f)
 				} else {
 					g.trigger.Reset(it.expire.Sub(now))
 					g.tmux.Unlock()
@@ -354,6 +617,28 @@ func (g *Gopher) timerLoop() {
 	}
 }
 
+func (g *Gopher) execTimer(f func()) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			logging.Error("Gopher[%v] exec timer failed: %v", g.Name, err)
+			debug.PrintStack()
+		}
+	}()
+	f()
+}
+
+// timerNum returns the num of timers outstanding.
+func (g *Gopher) timerNum() int {
+	g.tmux.Lock()
+	n := g.timers.Len()
+	g.tmux.Unlock()
+	for _, w := range g.wheels {
+		n += w.len()
+	}
+	return n
+}
+
 // PollerBuffer returns Poller's buffer by Conn, can be used on linux/bsd
 func (g *Gopher) PollerBuffer(c *Conn) []byte {
 	return g.pollers[uint32(c.Hash())%uint32(g.pollerNum)].ReadBuffer
@@ -373,6 +658,13 @@ func (g *Gopher) initHandlers() {
 	g.OnReadBufferAlloc(g.PollerBuffer)
 	g.OnReadBufferFree(func(c *Conn, buffer []byte) {})
 	g.OnWriteBufferRelease(func(c *Conn, buffer []byte) {})
+	g.OnWriteBufferHigh(func(c *Conn, size int) {})
+	g.OnWriteBufferLow(func(c *Conn, size int) {})
+	g.OnReadTimeout(func(c *Conn) { c.CloseWithError(errReadTimeout) })
+	g.OnWriteTimeout(func(c *Conn) { c.CloseWithError(errWriteTimeout) })
+	g.OnHalfClose(func(c *Conn) { c.CloseWithError(io.EOF) })
+	g.OnAccept(func(remote net.Addr) bool { return true })
+	g.OnReject(func(conn net.Conn, err error) {})
 	g.BeforeRead(func(c *Conn) {})
 	g.AfterRead(func(c *Conn) {})
 	g.BeforeWrite(func(c *Conn) {})
@@ -7,6 +7,7 @@
 package nbio
 
 import (
+	"net"
 	"runtime"
 	"strings"
 	"time"
@@ -18,23 +19,41 @@ import (
 func (g *Gopher) Start() error {
 	var err error
 
+	if g.filterErr != nil {
+		return g.filterErr
+	}
+
+	if g.handoffPath != "" {
+		return errHandoffUnsupported
+	}
+	if len(g.listenerFds) > 0 || g.systemdActivation {
+		return errInheritUnsupported
+	}
+
 	g.lfds = []int{}
 
-	g.listeners = make([]*poller, len(g.addrs))
-	for i := range g.addrs {
-		g.listeners[i], err = newPoller(g, true, int(i))
-		if err != nil {
-			for j := 0; j < i; j++ {
-				g.listeners[j].stop()
+	g.listeners = nil
+	if len(g.inheritedListeners) > 0 {
+		for i, ln := range g.inheritedListeners {
+			g.listeners = append(g.listeners, newListenerPoller(g, ln, i))
+		}
+	} else {
+		for i := range g.addrs {
+			ln, err := net.Listen(g.network, g.addrs[i])
+			if err != nil {
+				for j := 0; j < i; j++ {
+					g.listeners[j].stop()
+				}
+				return err
 			}
-			return err
+			g.listeners = append(g.listeners, newListenerPoller(g, ln, i))
 		}
 	}
 
 	for i := 0; i < g.pollerNum; i++ {
-		g.pollers[i], err = newPoller(g, false, int(i))
+		g.pollers[i], err = newPoller(g, int(i))
 		if err != nil {
-			for j := 0; j < len(g.addrs); j++ {
+			for j := 0; j < len(g.listeners); j++ {
 				g.listeners[j].stop()
 			}
 
@@ -56,8 +75,21 @@ func (g *Gopher) Start() error {
 
 	g.Add(1)
 	go g.timerLoop()
+	for _, w := range g.wheels {
+		g.Add(1)
+		go w.loop()
+	}
+	if g.idleTimeout > 0 {
+		g.startIdleSweepers(g.idleTimeout)
+	}
 
-	if len(g.addrs) == 0 {
+	if len(g.inheritedListeners) > 0 {
+		addrs := make([]string, 0, len(g.inheritedListeners))
+		for _, ln := range g.inheritedListeners {
+			addrs = append(addrs, ln.Addr().String())
+		}
+		logging.Info("Gopher[%v] start with inherited sockets, listen on: [\"%v\"]", g.Name, strings.Join(addrs, `", "`))
+	} else if len(g.addrs) == 0 {
 		logging.Info("Gopher[%v] start", g.Name)
 	} else {
 		logging.Info("Gopher[%v] start listen on: [\"%v\"]", g.Name, strings.Join(g.addrs, `", "`))
@@ -65,6 +97,22 @@ func (g *Gopher) Start() error {
 	return nil
 }
 
+// sweepIdle closes the idle conns of the poller.
+func (g *Gopher) sweepIdle(index int) {
+	var conns []*Conn
+	g.mux.Lock()
+	for c := range g.connsStd {
+		if c.Hash()%g.pollerNum == index {
+			conns = append(conns, c)
+		}
+	}
+	g.mux.Unlock()
+	now := time.Now().UnixNano()
+	for _, c := range conns {
+		c.closeIdle(now)
+	}
+}
+
 // NewGopher is a factory impl
 func NewGopher(conf Config) *Gopher {
 	cpuNum := runtime.NumCPU()
@@ -80,6 +128,12 @@ func NewGopher(conf Config) *Gopher {
 	if conf.MinConnCacheSize == 0 {
 		conf.MinConnCacheSize = DefaultMinConnCacheSize
 	}
+	if conf.TimerWheelTick <= 0 {
+		conf.TimerWheelTick = DefaultTimerWheelTick
+	}
+	if conf.ProxyProtocolTimeout <= 0 {
+		conf.ProxyProtocolTimeout = DefaultProxyProtocolTimeout
+	}
 
 	g := &Gopher{
 		Name:               conf.Name,
@@ -89,15 +143,41 @@ func NewGopher(conf Config) *Gopher {
 		readBufferSize:     conf.ReadBufferSize,
 		maxWriteBufferSize: conf.MaxWriteBufferSize,
 		minConnCacheSize:   conf.MinConnCacheSize,
+		wHighWatermark:     conf.WriteBufferHighWatermark,
+		wLowWatermark:      conf.WriteBufferLowWatermark,
 		lockListener:       conf.LockListener,
 		lockPoller:         conf.LockPoller,
+		handoffPath:        conf.HandoffPath,
+		inheritedListeners: conf.Listeners,
+		listenerFds:        conf.ListenerFds,
+		systemdActivation:  conf.SystemdSocketActivation,
 		listeners:          make([]*poller, len(conf.Addrs)),
 		pollers:            make([]*poller, conf.NPoller),
 		connsStd:           map[*Conn]struct{}{},
-		trigger:            time.NewTimer(timeForever),
-		chTimer:            make(chan struct{}),
+		idleTimeout:        conf.IdleTimeout,
+		stats:              &gopherStats{},
+
+		proxyProtocol:        conf.ProxyProtocol,
+		proxyProtocolTimeout: conf.ProxyProtocolTimeout,
+
+		connReadRate:   conf.ConnReadRate,
+		connReadBurst:  conf.ConnReadBurst,
+		connWriteRate:  conf.ConnWriteRate,
+		connWriteBurst: conf.ConnWriteBurst,
+		readLimiter:    newRateLimiter(conf.ReadRate, conf.ReadBurst),
+		writeLimiter:   newRateLimiter(conf.WriteRate, conf.WriteBurst),
+
+		trigger: time.NewTimer(timeForever),
+		chTimer: make(chan struct{}),
 	}
 
+	if conf.TimerWheel {
+		g.initTimingWheels(conf.TimerWheelTick)
+	}
+
+	g.admission = newAdmission(&conf)
+	g.filterErr = g.SetCIDRFilter(conf.AllowCIDRs, conf.DenyCIDRs)
+
 	g.initHandlers()
 
 	g.OnReadBufferAlloc(func(c *Conn) []byte {
@@ -18,19 +18,41 @@ import (
 // Start init and start pollers
 func (g *Gopher) Start() error {
 	var err error
+	var h *inherited
 
-	for i := 0; i < len(g.addrs); i++ {
-		g.listeners[i], err = newPoller(g, true, int(i))
-		if err != nil {
-			for j := 0; j < int(i); j++ {
-				g.listeners[j].stop()
+	if g.filterErr != nil {
+		return g.filterErr
+	}
+
+	if g.handoffPath != "" {
+		h, err = receiveHandoff(g.handoffPath, DefaultHandoffTimeout)
+	} else {
+		h, err = g.inheritSockets()
+	}
+	if err != nil {
+		return err
+	}
+
+	g.listeners = nil
+	if h != nil {
+		for i, ln := range h.listeners {
+			g.listeners = append(g.listeners, newListenerPoller(g, ln, i))
+		}
+	} else if !isUDPNetwork(g.network) {
+		for i := 0; i < len(g.addrs)*g.listenerNum; i++ {
+			ln, err := listenStream(g.network, g.addrs[i%len(g.addrs)], g.reusePort)
+			if err != nil {
+				for j := 0; j < len(g.listeners); j++ {
+					g.listeners[j].stop()
+				}
+				return err
 			}
-			return err
+			g.listeners = append(g.listeners, newListenerPoller(g, ln, i))
 		}
 	}
 
 	for i := 0; i < g.pollerNum; i++ {
-		g.pollers[i], err = newPoller(g, false, int(i))
+		g.pollers[i], err = newPoller(g, int(i))
 		if err != nil {
 			for j := 0; j < int(len(g.lfds)); j++ {
 				syscall.Close(g.lfds[j])
@@ -43,10 +65,43 @@ func (g *Gopher) Start() error {
 			for j := 0; j < int(i); j++ {
 				g.pollers[j].stop()
 			}
+
+			if h != nil {
+				h.listeners = nil
+				h.close()
+			}
 			return err
 		}
 	}
 
+	if h != nil {
+		for _, c := range h.udps {
+			g.pollers[uint32(c.Hash())%uint32(g.pollerNum)].addConn(c)
+		}
+		for _, c := range h.conns {
+			g.pollers[uint32(c.Hash())%uint32(g.pollerNum)].addConn(c)
+		}
+	} else if isUDPNetwork(g.network) {
+		udps := make([]*Conn, 0, len(g.addrs)*g.listenerNum)
+		for i := 0; i < len(g.addrs)*g.listenerNum; i++ {
+			var c *Conn
+			c, err = listenUDP(g.network, g.addrs[i%len(g.addrs)], g.reusePort)
+			if err != nil {
+				// the pollers have not been started, release the sockets and the pollers' fds directly
+				for _, c := range udps {
+					g.connsUnix[c.fd] = nil
+					syscall.Close(c.fd)
+				}
+				for j := 0; j < g.pollerNum; j++ {
+					g.pollers[j].closeFds()
+				}
+				return err
+			}
+			g.pollers[uint32(c.Hash())%uint32(g.pollerNum)].addConn(c)
+			udps = append(udps, c)
+		}
+	}
+
 	for i := 0; i < g.pollerNum; i++ {
 		g.pollers[i].ReadBuffer = make([]byte, g.readBufferSize)
 		g.Add(1)
@@ -59,8 +114,25 @@ func (g *Gopher) Start() error {
 
 	g.Add(1)
 	go g.timerLoop()
+	for _, w := range g.wheels {
+		g.Add(1)
+		go w.loop()
+	}
+	if g.idleTimeout > 0 {
+		g.startIdleSweepers(g.idleTimeout)
+	}
 
-	if len(g.addrs) == 0 {
+	if h != nil {
+		h.ready()
+		addrs := make([]string, 0, len(h.listeners)+len(h.udps))
+		for _, ln := range h.listeners {
+			addrs = append(addrs, ln.Addr().String())
+		}
+		for _, c := range h.udps {
+			addrs = append(addrs, c.LocalAddr().String())
+		}
+		logging.Info("Gopher[%v] start with inherited sockets, listen on: [\"%v\"]", g.Name, strings.Join(addrs, `", "`))
+	} else if len(g.addrs) == 0 {
 		logging.Info("Gopher[%v] start", g.Name)
 	} else {
 		logging.Info("Gopher[%v] start listen on: [\"%v\"]", g.Name, strings.Join(g.addrs, `", "`))
@@ -68,6 +140,18 @@ func (g *Gopher) Start() error {
 	return nil
 }
 
+// sweepIdle closes the idle conns of the poller on its goroutine, where its conns are read and closed.
+func (g *Gopher) sweepIdle(index int) {
+	g.pollers[index].exec(func() {
+		now := time.Now().UnixNano()
+		for fd := index; fd < len(g.connsUnix); fd += g.pollerNum {
+			if c := g.connsUnix[fd]; c != nil {
+				c.closeIdle(now)
+			}
+		}
+	})
+}
+
 // NewGopher is a factory impl
 func NewGopher(conf Config) *Gopher {
 	cpuNum := runtime.NumCPU()
@@ -79,6 +163,12 @@ func NewGopher(conf Config) *Gopher {
 	}
 	if len(conf.Addrs) > 0 && conf.NListener <= 0 {
 		conf.NListener = 1
+		if conf.ReusePort {
+			conf.NListener = conf.NPoller
+		}
+	}
+	if !conf.ReusePort || isUnixNetwork(conf.Network) {
+		conf.NListener = 1
 	}
 	if conf.Backlog <= 0 {
 		conf.Backlog = 1024 * 64
@@ -89,26 +179,66 @@ func NewGopher(conf Config) *Gopher {
 	if conf.MinConnCacheSize == 0 {
 		conf.MinConnCacheSize = DefaultMinConnCacheSize
 	}
+	if conf.TimerWheelTick <= 0 {
+		conf.TimerWheelTick = DefaultTimerWheelTick
+	}
+	if conf.ProxyProtocolTimeout <= 0 {
+		conf.ProxyProtocolTimeout = DefaultProxyProtocolTimeout
+	}
+	if conf.UDPReadTimeout <= 0 {
+		conf.UDPReadTimeout = DefaultUDPReadTimeout
+	}
 
 	g := &Gopher{
 		Name:               conf.Name,
 		network:            conf.Network,
 		addrs:              conf.Addrs,
 		pollerNum:          conf.NPoller,
+		listenerNum:        conf.NListener,
+		reusePort:          conf.ReusePort,
 		backlogSize:        conf.Backlog,
 		readBufferSize:     conf.ReadBufferSize,
 		maxWriteBufferSize: conf.MaxWriteBufferSize,
 		minConnCacheSize:   conf.MinConnCacheSize,
+		wHighWatermark:     conf.WriteBufferHighWatermark,
+		wLowWatermark:      conf.WriteBufferLowWatermark,
+		zeroCopyThreshold:  conf.ZeroCopyThreshold,
 		lockListener:       conf.LockListener,
 		lockPoller:         conf.LockPoller,
+		udpVirtualConn:     conf.UDPVirtualConn,
+		udpReadTimeout:     conf.UDPReadTimeout,
+		handoffPath:        conf.HandoffPath,
+		inheritedListeners: conf.Listeners,
+		listenerFds:        conf.ListenerFds,
+		systemdActivation:  conf.SystemdSocketActivation,
+		systemdFdNames:     conf.SystemdFdNames,
 		listeners:          make([]*poller, len(conf.Addrs)),
 		pollers:            make([]*poller, conf.NPoller),
 		connsUnix:          make([]*Conn, MaxOpenFiles),
+		idleTimeout:        conf.IdleTimeout,
+		stats:              &gopherStats{},
+
+		proxyProtocol:        conf.ProxyProtocol,
+		proxyProtocolTimeout: conf.ProxyProtocolTimeout,
+
+		connReadRate:   conf.ConnReadRate,
+		connReadBurst:  conf.ConnReadBurst,
+		connWriteRate:  conf.ConnWriteRate,
+		connWriteBurst: conf.ConnWriteBurst,
+		readLimiter:    newRateLimiter(conf.ReadRate, conf.ReadBurst),
+		writeLimiter:   newRateLimiter(conf.WriteRate, conf.WriteBurst),
 
 		trigger: time.NewTimer(timeForever),
 		chTimer: make(chan struct{}),
 	}
 
+	if conf.TimerWheel {
+		g.initTimingWheels(conf.TimerWheelTick)
+	}
+
+	g.admission = newAdmission(&conf)
+	g.filterErr = g.SetCIDRFilter(conf.AllowCIDRs, conf.DenyCIDRs)
+
 	g.initHandlers()
 
 	return g
@@ -0,0 +1,22 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package nbio
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errHandoffUnsupported = errors.New("handoff is not supported on windows")
+	errInheritUnsupported = errors.New("inheriting socket fds is not supported on windows")
+)
+
+// ServeHandoff is not supported on windows.
+func (g *Gopher) ServeHandoff(path string, timeout time.Duration, connFilter func(c *Conn) bool) error {
+	return errHandoffUnsupported
+}
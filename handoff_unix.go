@@ -0,0 +1,282 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lesismal/nbio/logging"
+)
+
+const (
+	handoffEnd   = 0
+	handoffAck   = 'A'
+	handoffReady = 'R'
+
+	// handoffMaxFds limits fds per message, SCM_MAX_FD is 253 on linux.
+	handoffMaxFds = 200
+)
+
+var errInvalidHandoff = errors.New("invalid handoff message")
+
+// ServeHandoff passes the Gopher's listener fds to a new process whose Config.HandoffPath is path,
+// over a unix socket with SCM_RIGHTS.
+// if connFilter is not nil, the conns it returns true for are passed too, these conns should be idle,
+// they are removed from the Gopher and closed with errHandoff after the new process is ready,
+// or added back to the Gopher if the handoff fails.
+// it returns after the new process has started, and the Gopher stops accepting,
+// then the caller should drain the in-flight conns, e.g. by nbhttp.Server.Shutdown, and exit.
+func (g *Gopher) ServeHandoff(path string, timeout time.Duration, connFilter func(c *Conn) bool) error {
+	if timeout <= 0 {
+		timeout = DefaultHandoffTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: path})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	ln.SetDeadline(deadline)
+
+	uc, err := ln.AcceptUnix()
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+	uc.SetDeadline(deadline)
+
+	var (
+		fds    []int
+		dupFds []int
+		kinds  []byte
+		udps   []*Conn
+		conns  []*Conn
+	)
+	defer func() {
+		for _, fd := range dupFds {
+			syscall.Close(fd)
+		}
+	}()
+
+	for _, l := range g.listeners {
+		fd, err := dupListenerFd(l.listener)
+		if err != nil {
+			return err
+		}
+		dupFds = append(dupFds, fd)
+		fds = append(fds, fd)
+		kinds = append(kinds, sockKindListener)
+	}
+	for _, c := range g.connsUnix {
+		if c == nil {
+			continue
+		}
+		switch c.typ {
+		case connTypeUDPServer:
+			udps = append(udps, c)
+			fds = append(fds, c.fd)
+			kinds = append(kinds, sockKindUDP)
+		case connTypeTCP, connTypeUnix:
+			if connFilter != nil && connFilter(c) && c.detach() {
+				conns = append(conns, c)
+				fds = append(fds, c.fd)
+				kinds = append(kinds, sockKindConn)
+			}
+		}
+	}
+	ready := false
+	defer func() {
+		for _, c := range conns {
+			if ready {
+				c.closeWithError(errHandoff)
+			} else {
+				// the new process closes the fds it received when it fails, keep serving the conns
+				c.attach()
+			}
+		}
+	}()
+
+	buf := make([]byte, 1)
+	for len(fds) > 0 {
+		n := len(fds)
+		if n > handoffMaxFds {
+			n = handoffMaxFds
+		}
+		if _, _, err = uc.WriteMsgUnix(kinds[:n], syscall.UnixRights(fds[:n]...), nil); err != nil {
+			return err
+		}
+		// wait for ack before the next message, to avoid the receiver reading several messages at once
+		if _, err = uc.Read(buf); err != nil {
+			return err
+		}
+		if buf[0] != handoffAck {
+			return errInvalidHandoff
+		}
+		fds, kinds = fds[n:], kinds[n:]
+	}
+	if _, err = uc.Write([]byte{handoffEnd}); err != nil {
+		return err
+	}
+	if _, err = uc.Read(buf); err != nil {
+		return err
+	}
+	if buf[0] != handoffReady {
+		return errInvalidHandoff
+	}
+	ready = true
+
+	for _, l := range g.listeners {
+		// the new process owns the socket file now
+		if ul, ok := l.listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.stop()
+	}
+	for _, c := range udps {
+		c.closeWithError(errHandoff)
+	}
+
+	logging.Info("Gopher[%v] handoff %v listeners, %v udp sockets, %v conns to [%v]", g.Name, len(g.listeners), len(udps), len(conns), path)
+
+	return nil
+}
+
+// detach removes an idle Conn from its poller without closing the fd.
+func (c *Conn) detach() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed || c.dialer != nil || c.leftSize > 0 {
+		return false
+	}
+	if c.g.connsUnix[c.fd] == c {
+		p := c.g.pollers[c.Hash()%len(c.g.pollers)]
+		c.g.connsUnix[c.fd] = nil
+		p.deleteEvent(c.fd)
+		atomic.AddInt64(&p.online, -1)
+	}
+	return true
+}
+
+// attach adds a Conn removed by detach back to its poller.
+func (c *Conn) attach() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed || c.g.connsUnix[c.fd] != nil {
+		return
+	}
+	p := c.g.pollers[c.Hash()%len(c.g.pollers)]
+	c.g.connsUnix[c.fd] = c
+	p.addRead(c.fd)
+	if c.readDisabled() {
+		p.pauseRead(c.fd, c.isWAdded)
+	} else if c.isWAdded {
+		p.resumeRead(c.fd, true)
+	}
+	atomic.AddInt64(&p.online, 1)
+}
+
+func dupListenerFd(ln net.Listener) (int, error) {
+	sc, ok := ln.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return -1, errors.New("RawConn Unsupported")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	newFd := -1
+	errCtrl := rc.Control(func(fd uintptr) {
+		newFd, err = syscall.Dup(int(fd))
+	})
+	if errCtrl != nil {
+		return -1, errCtrl
+	}
+	return newFd, err
+}
+
+func receiveHandoff(path string, timeout time.Duration) (*inherited, error) {
+	if timeout <= 0 {
+		timeout = DefaultHandoffTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// the old process may not be serving the handoff yet
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.DialTimeout("unix", path, time.Until(deadline))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(time.Second / 20)
+	}
+
+	h := &inherited{conn: conn.(*net.UnixConn)}
+	h.conn.SetDeadline(deadline)
+
+	buf := make([]byte, handoffMaxFds)
+	oob := make([]byte, syscall.CmsgSpace(handoffMaxFds*4))
+	for {
+		n, oobn, _, _, err := h.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			h.close()
+			return nil, err
+		}
+
+		if n == 1 && oobn == 0 && buf[0] == handoffEnd {
+			return h, nil
+		}
+
+		var fds []int
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err == nil {
+			for i := range msgs {
+				var rights []int
+				rights, err = syscall.ParseUnixRights(&msgs[i])
+				if err != nil {
+					break
+				}
+				fds = append(fds, rights...)
+			}
+		}
+		if err == nil && len(fds) != n {
+			err = errInvalidHandoff
+		}
+		if err != nil {
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+			h.close()
+			return nil, err
+		}
+
+		for i, fd := range fds {
+			if e := h.adopt(buf[i], fd); e != nil && err == nil {
+				err = e
+			}
+		}
+		if err == nil {
+			_, err = h.conn.Write([]byte{handoffAck})
+		}
+		if err != nil {
+			h.close()
+			return nil, err
+		}
+	}
+}
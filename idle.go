@@ -0,0 +1,84 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minIdleSweepInterval = time.Second / 10
+	maxIdleSweepInterval = time.Second
+)
+
+// SetIdleTimeout sets the idle timeout of the Conn, which overrides Config.IdleTimeout,
+// the Conn is closed with ErrIdleTimeout if nothing is read or written during timeout.
+// timeout <= 0 disables it for the Conn. udp Conns are not swept.
+func (c *Conn) SetIdleTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		atomic.StoreInt64(&c.idleTimeout, -1)
+		return
+	}
+	atomic.StoreInt64(&c.idleTimeout, int64(timeout))
+	if c.g != nil {
+		c.g.startIdleSweepers(timeout)
+	}
+}
+
+// lastActive returns the last time in unix nano that the Conn is opened, read or written.
+func (c *Conn) lastActive() int64 {
+	last := atomic.LoadInt64(&c.stats.createdAt)
+	if t := atomic.LoadInt64(&c.stats.lastRead); t > last {
+		last = t
+	}
+	if t := atomic.LoadInt64(&c.stats.lastWrite); t > last {
+		last = t
+	}
+	return last
+}
+
+func (c *Conn) isIdle(now int64) bool {
+	timeout := atomic.LoadInt64(&c.idleTimeout)
+	if timeout == 0 {
+		timeout = int64(c.g.idleTimeout)
+	}
+	if timeout <= 0 {
+		return false
+	}
+	last := c.lastActive()
+	return last > 0 && now-last >= timeout
+}
+
+// startIdleSweepers starts a sweeper for each poller, which checks its conns every
+// timeout/10, bounded by minIdleSweepInterval and maxIdleSweepInterval.
+func (g *Gopher) startIdleSweepers(timeout time.Duration) {
+	g.idleOnce.Do(func() {
+		interval := timeout / 10
+		if interval < minIdleSweepInterval {
+			interval = minIdleSweepInterval
+		} else if interval > maxIdleSweepInterval {
+			interval = maxIdleSweepInterval
+		}
+		for i := 0; i < g.pollerNum; i++ {
+			g.Add(1)
+			go g.idleSweepLoop(i, interval)
+		}
+	})
+}
+
+func (g *Gopher) idleSweepLoop(index int, interval time.Duration) {
+	defer g.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.sweepIdle(index)
+		case <-g.chTimer:
+			return
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	sockKindListener = 'L'
+	sockKindUDP      = 'U'
+	sockKindConn     = 'C'
+
+	// systemdListenFdsStart is SD_LISTEN_FDS_START.
+	systemdListenFdsStart = 3
+)
+
+var errInvalidSocket = errors.New("invalid inherited socket")
+
+var (
+	systemdMux sync.Mutex
+	// systemdTaken records the fds passed by systemd which have been adopted by a Gopher of the process,
+	// they may have been closed and the fd numbers reused since.
+	systemdTaken = map[int]struct{}{}
+)
+
+// inherited holds the sockets received from the old process by handoff, passed by systemd, or set in Config.
+type inherited struct {
+	conn      *net.UnixConn
+	listeners []net.Listener
+	udps      []*Conn
+	conns     []*Conn
+}
+
+// inheritSockets collects the sockets set in Config.Listeners, Config.ListenerFds and passed by systemd,
+// it returns nil if there is none.
+func (g *Gopher) inheritSockets() (*inherited, error) {
+	fds := g.listenerFds
+	if g.systemdActivation {
+		sdFds, err := systemdFds(g.systemdFdNames)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(append([]int{}, fds...), sdFds...)
+	}
+	if len(g.inheritedListeners) == 0 && len(fds) == 0 {
+		return nil, nil
+	}
+
+	h := &inherited{listeners: append([]net.Listener{}, g.inheritedListeners...)}
+	var err error
+	for _, fd := range fds {
+		kind, e := socketKind(fd)
+		if e == nil {
+			e = h.adopt(kind, fd)
+		} else {
+			syscall.Close(fd)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		h.close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// socketKind tells a listening socket from a connected one by SO_ACCEPTCONN.
+func socketKind(fd int) (byte, error) {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case syscall.SOCK_DGRAM:
+		return sockKindUDP, nil
+	case syscall.SOCK_STREAM:
+		accepting, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return 0, err
+		}
+		if accepting != 0 {
+			return sockKindListener, nil
+		}
+		return sockKindConn, nil
+	}
+	return 0, errInvalidSocket
+}
+
+// systemdFds returns the fds passed by systemd socket activation, filtered by names if not empty.
+// the environment is kept so that several Gophers can adopt different sockets by names,
+// child processes ignore it for LISTEN_PID mismatch. each fd is returned only once in the process.
+func systemdFds(names []string) ([]int, error) {
+	pid := os.Getenv("LISTEN_PID")
+	nfds := os.Getenv("LISTEN_FDS")
+	fdNames := os.Getenv("LISTEN_FDNAMES")
+
+	if pid == "" || nfds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid LISTEN_FDS: " + nfds)
+	}
+
+	var fdNameList []string
+	if fdNames != "" {
+		fdNameList = strings.Split(fdNames, ":")
+	}
+
+	systemdMux.Lock()
+	defer systemdMux.Unlock()
+	fds := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		fd := systemdListenFdsStart + i
+		if _, taken := systemdTaken[fd]; taken {
+			continue
+		}
+		if len(names) > 0 {
+			matched := false
+			if i < len(fdNameList) {
+				for _, name := range names {
+					if name == fdNameList[i] {
+						matched = true
+						break
+					}
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		systemdTaken[fd] = struct{}{}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// adopt converts an inherited fd to a listener or a Conn, the fd is always closed.
+func (h *inherited) adopt(kind byte, fd int) error {
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+
+	switch kind {
+	case sockKindListener:
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		h.listeners = append(h.listeners, ln)
+	case sockKindUDP:
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		uc, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return errInvalidSocket
+		}
+		c, err := dupStdConn(uc)
+		if err != nil {
+			return err
+		}
+		c.typ = connTypeUDPServer
+		c.udp = &udpConn{conns: map[string]*Conn{}}
+		h.udps = append(h.udps, c)
+	case sockKindConn:
+		conn, err := net.FileConn(f)
+		if err != nil {
+			return err
+		}
+		c, err := dupStdConn(conn)
+		if err != nil {
+			return err
+		}
+		h.conns = append(h.conns, c)
+	default:
+		return errInvalidSocket
+	}
+	return nil
+}
+
+// ready notifies the old process to stop accepting if the sockets are received by handoff.
+func (h *inherited) ready() {
+	if h.conn != nil {
+		h.conn.Write([]byte{handoffReady})
+		h.conn.Close()
+	}
+}
+
+func (h *inherited) close() {
+	for _, ln := range h.listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		ln.Close()
+	}
+	for _, c := range h.udps {
+		syscall.Close(c.fd)
+	}
+	for _, c := range h.conns {
+		syscall.Close(c.fd)
+	}
+	if h.conn != nil {
+		h.conn.Close()
+	}
+}
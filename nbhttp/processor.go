@@ -13,6 +13,7 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lesismal/nbio"
@@ -70,12 +71,16 @@ type ServerProcessor struct {
 	executor func(index int, f func())
 
 	resQueue       []*Response
+	maxPending     int
+	readPaused     bool
 	sequence       uint64
 	responsedSeq   uint64
 	minBufferSize  int
 	keepaliveTime  time.Duration
 	enableSendfile bool
 	isUpgrade      bool
+
+	stats *serverStats
 }
 
 // Conn .
@@ -221,12 +226,23 @@ func (p *ServerProcessor) OnComplete(parser *Parser) {
 	}
 
 	res := NewResponse(p.parser, request, p.enableSendfile)
+	if p.stats != nil {
+		res.start = time.Now()
+	}
 
 	if !p.isUpgrade {
 		var executing bool
+		if p.stats != nil {
+			atomic.AddInt64(&p.stats.pending, 1)
+		}
 		p.mux.Lock()
 		p.resQueue = append(p.resQueue, res)
 		executing = (p.resQueue[0] != res)
+		if p.maxPending > 0 && len(p.resQueue) >= p.maxPending && !p.readPaused {
+			// paused with the lock held, or the executor may resume it before it's paused
+			p.readPaused = true
+			p.pauseRead()
+		}
 		p.mux.Unlock()
 
 		index := 0
@@ -239,9 +255,16 @@ func (p *ServerProcessor) OnComplete(parser *Parser) {
 				for {
 					p.handler.ServeHTTP(res, res.request)
 					p.flushResponse(res)
+					if p.stats != nil {
+						atomic.AddInt64(&p.stats.pending, -1)
+					}
 
 					p.mux.Lock()
 					p.resQueue = p.resQueue[1:]
+					if p.readPaused && len(p.resQueue) < p.maxPending {
+						p.readPaused = false
+						p.resumeRead()
+					}
 					if len(p.resQueue) == 0 {
 						p.resQueue = nil
 						p.mux.Unlock()
@@ -259,6 +282,42 @@ func (p *ServerProcessor) OnComplete(parser *Parser) {
 	}
 }
 
+// SetMaxPending sets max requests waiting for the handler, the Conn's reading is paused when it's reached.
+func (p *ServerProcessor) SetMaxPending(n int) {
+	p.mux.Lock()
+	p.maxPending = n
+	p.mux.Unlock()
+}
+
+// pauseRead and resumeRead should be called with the lock held, to keep the Conn's state in order with readPaused.
+func (p *ServerProcessor) pauseRead() {
+	if c := p.nbioConn(); c != nil {
+		c.PauseRead()
+	}
+}
+
+func (p *ServerProcessor) resumeRead() {
+	if c := p.nbioConn(); c != nil {
+		c.ResumeRead()
+	}
+}
+
+// nbioConn returns the underlying *nbio.Conn, which may be wrapped by tls.
+func (p *ServerProcessor) nbioConn() *nbio.Conn {
+	switch c := p.conn.(type) {
+	case *nbio.Conn:
+		return c
+	case interface{ Conn() net.Conn }:
+		switch nc := c.Conn().(type) {
+		case *nbio.Conn:
+			return nc
+		case *tlsWriter:
+			return nc.Conn
+		}
+	}
+	return nil
+}
+
 // HandleExecute .
 func (p *ServerProcessor) HandleExecute(executor func(index int, f func())) {
 	if executor != nil {
@@ -274,6 +333,9 @@ func (p *ServerProcessor) flushResponse(res *Response) {
 			p.conn.Close()
 			return
 		}
+		if p.stats != nil {
+			p.stats.onResponse(res.statusCode, time.Since(res.start))
+		}
 		if req.Close {
 			// the data may still in the send queue
 			p.conn.Close()
@@ -287,14 +349,23 @@ func (p *ServerProcessor) flushResponse(res *Response) {
 
 // Clear .
 func (p *ServerProcessor) Clear() {
-	// p.mux.Lock()
-	// defer p.mux.Unlock()
-	for _, res := range p.resQueue {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.resQueue) == 0 {
+		return
+	}
+	// the head is being handled by the executor, which removes it and decrements pending after it's done
+	queued := p.resQueue[1:]
+	if p.stats != nil {
+		atomic.AddInt64(&p.stats.pending, -int64(len(queued)))
+	}
+	for i, res := range queued {
 		releaseRequest(res.request)
 		releaseResponse(res)
+		queued[i] = nil
 		p.responsedSeq++
 	}
-	p.resQueue = nil
+	p.resQueue = p.resQueue[:1]
 }
 
 // HandleMessage .
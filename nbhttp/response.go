@@ -12,6 +12,8 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"github.com/lesismal/nbio"
 )
 
 var (
@@ -33,6 +35,7 @@ type Response struct {
 	parser *Parser
 
 	request *http.Request // request for this response
+	start   time.Time     // time when the request is parsed
 
 	status     string
 	statusCode int // status code passed to WriteHeader
@@ -181,11 +184,16 @@ func (res *Response) ReadFrom(r io.Reader) (n int64, err error) {
 
 		f, ok := r.(*os.File)
 		if ok {
+			if nc, ok := c.(rangeSender); ok {
+				if ns, err := sendfileRange(nc, f, n); err == nil {
+					return ns, nil
+				}
+			}
 			nc, ok := c.(interface {
 				Sendfile(f *os.File, remain int64) (int64, error)
 			})
 			if ok {
-				ns, err := nc.Sendfile(f, lr.N)
+				ns, err := nc.Sendfile(f, n)
 				return int64(ns), err
 			}
 		}
@@ -194,6 +202,42 @@ func (res *Response) ReadFrom(r io.Reader) (n int64, err error) {
 	return io.Copy(c, r)
 }
 
+type rangeSender interface {
+	SendfileRange(f *os.File, offset, length int64, done func(c *nbio.Conn, n int64, err error)) error
+}
+
+// sendfileRange queues n bytes of f from its offset to c without blocking, n <= 0 means to the end of f.
+// a duplicate of f is sent since the handler may close f before it's sent, f's offset is moved as if it's read.
+func sendfileRange(c rangeSender, f *os.File, n int64) (int64, error) {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		stat, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		n = stat.Size() - offset
+		if n <= 0 {
+			return 0, nil
+		}
+	}
+	df, err := dupFile(f)
+	if err != nil {
+		return 0, err
+	}
+	err = c.SendfileRange(df, offset, n, func(c *nbio.Conn, n int64, err error) {
+		df.Close()
+	})
+	if err != nil {
+		df.Close()
+		return 0, err
+	}
+	f.Seek(offset+n, io.SeekStart)
+	return n, nil
+}
+
 // checkChunked .
 func (res *Response) checkChunked() error {
 	if res.chunkChecked {
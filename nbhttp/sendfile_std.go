@@ -0,0 +1,17 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package nbhttp
+
+import (
+	"errors"
+	"os"
+)
+
+// dupFile is not supported on windows, where nbio.Conn.SendfileRange blocks.
+func dupFile(f *os.File) (*os.File, error) {
+	return nil, errors.New("not supported")
+}
@@ -7,6 +7,7 @@ package nbhttp
 import (
 	"context"
 	"math/rand"
+	"net"
 	"net/http"
 	"runtime"
 	"sync"
@@ -52,8 +53,7 @@ type Config struct {
 	Name string
 
 	// Network is the listening protocol, used with Addrs toghter.
-	// tcp* supported only by now, there's no plan for other protocol such as udp,
-	// because it's too easy to write udp server/client.
+	// tcp* and unix are supported.
 	Network string
 
 	// Addrs is the listening addr list for a nbio server.
@@ -66,9 +66,97 @@ type Config struct {
 	// NPoller represents poller goroutine num, it's set to runtime.NumCPU() by default.
 	NPoller int
 
-	// NListener represents poller goroutine num, it's set to runtime.NumCPU() by default.
+	// NListener represents listener num for each addr, it works with ReusePort only.
+	// it's set to NPoller by default if ReusePort is true, else 1.
 	NListener int
 
+	// ReusePort represents whether to bind NListener sockets with SO_REUSEPORT for each addr.
+	ReusePort bool
+
+	// HandoffPath represents the unix socket path to receive listeners from a running Server which calls Handoff.
+	HandoffPath string
+
+	// Listeners represents listeners opened by the caller, Addrs is ignored if it's not empty.
+	Listeners []net.Listener
+
+	// ListenerFds represents inherited listening socket fds, Addrs is ignored if it's not empty.
+	ListenerFds []int
+
+	// SystemdSocketActivation represents whether to adopt the sockets passed by systemd.
+	SystemdSocketActivation bool
+
+	// SystemdFdNames represents the names in LISTEN_FDNAMES to adopt, all sockets are adopted if it's empty.
+	SystemdFdNames []string
+
+	// TimerWheel represents whether to use timing wheels instead of the timer heap for deadlines.
+	TimerWheel bool
+
+	// TimerWheelTick represents the tick of timing wheels, it's set to 10ms by default.
+	TimerWheelTick time.Duration
+
+	// IdleTimeout represents the time to close a Conn if nothing is read or written, see nbio.Config.IdleTimeout.
+	IdleTimeout time.Duration
+
+	// ZeroCopyThreshold represents the min size of a write to send with MSG_ZEROCOPY on linux, see nbio.Config.ZeroCopyThreshold.
+	ZeroCopyThreshold int
+
+	// MaxConnsPerIP represents the max num of concurrent conns from a source ip or prefix, see nbio.Config.MaxConnsPerIP.
+	MaxConnsPerIP int
+
+	// AcceptRate represents the num of conns accepted per second, see nbio.Config.AcceptRate.
+	AcceptRate float64
+
+	// AcceptBurst represents the burst of AcceptRate.
+	AcceptBurst int
+
+	// AcceptRatePerIP represents the num of conns accepted per second from a source ip or prefix, see nbio.Config.AcceptRatePerIP.
+	AcceptRatePerIP float64
+
+	// AcceptBurstPerIP represents the burst of AcceptRatePerIP.
+	AcceptBurstPerIP int
+
+	// IPv4PrefixLen represents the prefix length to group ipv4 sources, it's set to 32 by default.
+	IPv4PrefixLen int
+
+	// IPv6PrefixLen represents the prefix length to group ipv6 sources, it's set to 128 by default.
+	IPv6PrefixLen int
+
+	// AllowCIDRs represents the CIDRs or ips to accept conns from, see nbio.Config.AllowCIDRs.
+	AllowCIDRs []string
+
+	// DenyCIDRs represents the CIDRs or ips to reject conns from, see nbio.Config.DenyCIDRs.
+	DenyCIDRs []string
+
+	// ProxyProtocol represents whether the conns accepted begin with a PROXY protocol header, see nbio.Config.ProxyProtocol.
+	ProxyProtocol bool
+
+	// ProxyProtocolTimeout represents the time to wait for the PROXY protocol header, it's set to 5s by default.
+	ProxyProtocolTimeout time.Duration
+
+	// ConnReadRate represents the max bytes per second read from a conn, see nbio.Config.ConnReadRate.
+	ConnReadRate int
+
+	// ConnReadBurst represents the burst of ConnReadRate, it's set to ConnReadRate by default.
+	ConnReadBurst int
+
+	// ConnWriteRate represents the max bytes per second written to a conn, see nbio.Config.ConnWriteRate.
+	ConnWriteRate int
+
+	// ConnWriteBurst represents the burst of ConnWriteRate, it's set to ConnWriteRate by default.
+	ConnWriteBurst int
+
+	// ReadRate represents the max bytes per second read from all conns, see nbio.Config.ReadRate.
+	ReadRate int
+
+	// ReadBurst represents the burst of ReadRate, it's set to ReadRate by default.
+	ReadBurst int
+
+	// WriteRate represents the max bytes per second written to all conns, see nbio.Config.WriteRate.
+	WriteRate int
+
+	// WriteBurst represents the burst of WriteRate, it's set to WriteRate by default.
+	WriteBurst int
+
 	// NParser represents parser goroutine num, it's set to NPoller by default.
 	NParser int
 
@@ -101,6 +189,15 @@ type Config struct {
 	// KeepaliveTime represents Conn's ReadDeadline when waiting for a new request, it's set to 120s by default.
 	KeepaliveTime time.Duration
 
+	// MaxPendingRequests represents max requests of a Conn waiting for the message handler,
+	// the Conn's reading is paused when it's reached and resumed after the requests are handled,
+	// it's set to 0 by default, which means no limit.
+	MaxPendingRequests int
+
+	// LatencyBuckets represents the upper bounds in seconds of the request latency histogram of HTTPStats,
+	// it's set to DefaultLatencyBuckets by default.
+	LatencyBuckets []float64
+
 	// EnableSendfile .
 	EnableSendfile bool
 }
@@ -120,6 +217,9 @@ type Server struct {
 	mux   sync.Mutex
 	conns map[*nbio.Conn]struct{}
 
+	stats              *serverStats
+	messageHandlerPool *taskpool.MixedPool
+
 	Malloc  func(size int) []byte
 	Realloc func(buf []byte, size int) []byte
 	Free    func(buf []byte) error
@@ -212,6 +312,19 @@ Exit:
 	return nil
 }
 
+// Handoff passes the listeners to a new process whose Config.HandoffPath is path,
+// then drains the in-flight requests by Shutdown.
+func (s *Server) Handoff(ctx context.Context, path string) error {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if err := s.ServeHandoff(path, timeout, nil); err != nil {
+		return err
+	}
+	return s.Shutdown(ctx)
+}
+
 // NewServer .
 func NewServer(conf Config, handler http.Handler, messageHandlerExecutor func(index int, f func())) *Server {
 	if conf.MaxLoad <= 0 {
@@ -269,15 +382,44 @@ func NewServer(conf Config, handler http.Handler, messageHandlerExecutor func(in
 	}
 
 	gopherConf := nbio.Config{
-		Name:               conf.Name,
-		Network:            conf.Network,
-		Addrs:              conf.Addrs,
-		NPoller:            conf.NPoller,
-		NListener:          conf.NListener,
-		ReadBufferSize:     conf.ReadBufferSize,
-		MaxWriteBufferSize: conf.MaxWriteBufferSize,
-		LockPoller:         conf.LockPoller,
-		LockListener:       conf.LockListener,
+		Name:                    conf.Name,
+		Network:                 conf.Network,
+		Addrs:                   conf.Addrs,
+		NPoller:                 conf.NPoller,
+		NListener:               conf.NListener,
+		ReusePort:               conf.ReusePort,
+		HandoffPath:             conf.HandoffPath,
+		Listeners:               conf.Listeners,
+		ListenerFds:             conf.ListenerFds,
+		SystemdSocketActivation: conf.SystemdSocketActivation,
+		SystemdFdNames:          conf.SystemdFdNames,
+		TimerWheel:              conf.TimerWheel,
+		TimerWheelTick:          conf.TimerWheelTick,
+		IdleTimeout:             conf.IdleTimeout,
+		ZeroCopyThreshold:       conf.ZeroCopyThreshold,
+		MaxConnsPerIP:           conf.MaxConnsPerIP,
+		AcceptRate:              conf.AcceptRate,
+		AcceptBurst:             conf.AcceptBurst,
+		AcceptRatePerIP:         conf.AcceptRatePerIP,
+		AcceptBurstPerIP:        conf.AcceptBurstPerIP,
+		IPv4PrefixLen:           conf.IPv4PrefixLen,
+		IPv6PrefixLen:           conf.IPv6PrefixLen,
+		AllowCIDRs:              conf.AllowCIDRs,
+		DenyCIDRs:               conf.DenyCIDRs,
+		ProxyProtocol:           conf.ProxyProtocol,
+		ProxyProtocolTimeout:    conf.ProxyProtocolTimeout,
+		ConnReadRate:            conf.ConnReadRate,
+		ConnReadBurst:           conf.ConnReadBurst,
+		ConnWriteRate:           conf.ConnWriteRate,
+		ConnWriteBurst:          conf.ConnWriteBurst,
+		ReadRate:                conf.ReadRate,
+		ReadBurst:               conf.ReadBurst,
+		WriteRate:               conf.WriteRate,
+		WriteBurst:              conf.WriteBurst,
+		ReadBufferSize:          conf.ReadBufferSize,
+		MaxWriteBufferSize:      conf.MaxWriteBufferSize,
+		LockPoller:              conf.LockPoller,
+		LockListener:            conf.LockListener,
 	}
 	g := nbio.NewGopher(gopherConf)
 
@@ -290,6 +432,8 @@ func NewServer(conf Config, handler http.Handler, messageHandlerExecutor func(in
 		ParserExecutor:         parserExecutor,
 		MessageHandlerExecutor: messageHandlerExecutor,
 		conns:                  map[*nbio.Conn]struct{}{},
+		stats:                  newServerStats(conf.LatencyBuckets),
+		messageHandlerPool:     messageHandlerExecutePool,
 
 		Malloc:  mempool.Malloc,
 		Realloc: mempool.Realloc,
@@ -310,6 +454,8 @@ func NewServer(conf Config, handler http.Handler, messageHandlerExecutor func(in
 		parser := NewParser(processor, false, conf.ReadLimit, conf.MinBufferSize)
 		parser.Server = svr
 		processor.(*ServerProcessor).parser = parser
+		processor.(*ServerProcessor).SetMaxPending(conf.MaxPendingRequests)
+		processor.(*ServerProcessor).stats = svr.stats
 		c.SetSession(parser)
 		c.SetReadDeadline(time.Now().Add(conf.KeepaliveTime))
 	})
@@ -362,6 +508,25 @@ func NewServer(conf Config, handler http.Handler, messageHandlerExecutor func(in
 	return svr
 }
 
+// tlsWriter passes a copy of each record to the nbio.Conn, because the tls.Conn reuses its record buffer
+// after Write returns, while the nbio.Conn keeps the buffer until it's sent, e.g. when the socket is not
+// writable or the buffer is sent with MSG_ZEROCOPY. the copies are released by OnWriteBufferRelease.
+type tlsWriter struct {
+	*nbio.Conn
+}
+
+// Write .
+func (w *tlsWriter) Write(b []byte) (int, error) {
+	buf := mempool.Malloc(len(b))
+	copy(buf, b)
+	return w.Conn.Write(buf)
+}
+
+// NBConn returns the underlying *nbio.Conn.
+func (w *tlsWriter) NBConn() *nbio.Conn {
+	return w.Conn
+}
+
 // NewServerTLS .
 func NewServerTLS(conf Config, handler http.Handler, messageHandlerExecutor func(index int, f func()), tlsConfig *tls.Config) *Server {
 	if conf.MaxLoad <= 0 {
@@ -432,14 +597,43 @@ func NewServerTLS(conf Config, handler http.Handler, messageHandlerExecutor func
 	}
 
 	gopherConf := nbio.Config{
-		Name:               conf.Name,
-		Network:            conf.Network,
-		Addrs:              conf.Addrs,
-		NPoller:            conf.NPoller,
-		NListener:          conf.NListener,
-		ReadBufferSize:     conf.ReadBufferSize,
-		MaxWriteBufferSize: conf.MaxWriteBufferSize,
-		LockPoller:         conf.LockPoller,
+		Name:                    conf.Name,
+		Network:                 conf.Network,
+		Addrs:                   conf.Addrs,
+		NPoller:                 conf.NPoller,
+		NListener:               conf.NListener,
+		ReusePort:               conf.ReusePort,
+		HandoffPath:             conf.HandoffPath,
+		Listeners:               conf.Listeners,
+		ListenerFds:             conf.ListenerFds,
+		SystemdSocketActivation: conf.SystemdSocketActivation,
+		SystemdFdNames:          conf.SystemdFdNames,
+		TimerWheel:              conf.TimerWheel,
+		TimerWheelTick:          conf.TimerWheelTick,
+		IdleTimeout:             conf.IdleTimeout,
+		ZeroCopyThreshold:       conf.ZeroCopyThreshold,
+		MaxConnsPerIP:           conf.MaxConnsPerIP,
+		AcceptRate:              conf.AcceptRate,
+		AcceptBurst:             conf.AcceptBurst,
+		AcceptRatePerIP:         conf.AcceptRatePerIP,
+		AcceptBurstPerIP:        conf.AcceptBurstPerIP,
+		IPv4PrefixLen:           conf.IPv4PrefixLen,
+		IPv6PrefixLen:           conf.IPv6PrefixLen,
+		AllowCIDRs:              conf.AllowCIDRs,
+		DenyCIDRs:               conf.DenyCIDRs,
+		ProxyProtocol:           conf.ProxyProtocol,
+		ProxyProtocolTimeout:    conf.ProxyProtocolTimeout,
+		ConnReadRate:            conf.ConnReadRate,
+		ConnReadBurst:           conf.ConnReadBurst,
+		ConnWriteRate:           conf.ConnWriteRate,
+		ConnWriteBurst:          conf.ConnWriteBurst,
+		ReadRate:                conf.ReadRate,
+		ReadBurst:               conf.ReadBurst,
+		WriteRate:               conf.WriteRate,
+		WriteBurst:              conf.WriteBurst,
+		ReadBufferSize:          conf.ReadBufferSize,
+		MaxWriteBufferSize:      conf.MaxWriteBufferSize,
+		LockPoller:              conf.LockPoller,
 	}
 	g := nbio.NewGopher(gopherConf)
 
@@ -453,6 +647,8 @@ func NewServerTLS(conf Config, handler http.Handler, messageHandlerExecutor func
 		ParserExecutor:         parserExecutor,
 		MessageHandlerExecutor: messageHandlerExecutor,
 		conns:                  map[*nbio.Conn]struct{}{},
+		stats:                  newServerStats(conf.LatencyBuckets),
+		messageHandlerPool:     messageHandlerExecutePool,
 
 		Malloc:  nativeAllocator.Malloc,
 		Realloc: nativeAllocator.Realloc,
@@ -474,12 +670,14 @@ func NewServerTLS(conf Config, handler http.Handler, messageHandlerExecutor func
 		svr.conns[c] = struct{}{}
 		svr.mux.Unlock()
 		svr._onOpen(c)
-		tlsConn := tls.NewConn(c, tlsConfig, isClient, true, conf.ReadBufferSize)
+		tlsConn := tls.NewConn(&tlsWriter{c}, tlsConfig, isClient, true, conf.ReadBufferSize)
 		processor := NewServerProcessor(tlsConn, handler, messageHandlerExecutor, conf.MinBufferSize, conf.KeepaliveTime, conf.EnableSendfile)
 		parser := NewParser(processor, false, conf.ReadLimit, conf.MinBufferSize)
 		parser.Server = svr
 		parser.TLSBuffer = make([]byte, conf.ReadBufferSize)
 		processor.(*ServerProcessor).parser = parser
+		processor.(*ServerProcessor).SetMaxPending(conf.MaxPendingRequests)
+		processor.(*ServerProcessor).stats = svr.stats
 		c.SetSession(parser)
 		c.SetReadDeadline(time.Now().Add(conf.KeepaliveTime))
 	})
@@ -532,9 +730,9 @@ func NewServerTLS(conf Config, handler http.Handler, messageHandlerExecutor func
 	// 	return mempool.Malloc(int(conf.ReadBufferSize))
 	// })
 	// g.OnReadBufferFree(func(c *nbio.Conn, buffer []byte) {})
-	// g.OnWriteBufferRelease(func(c *nbio.Conn, buffer []byte) {
-	// 	mempool.Free(buffer)
-	// })
+	g.OnWriteBufferRelease(func(c *nbio.Conn, buffer []byte) {
+		mempool.Free(buffer)
+	})
 
 	g.OnStop(func() {
 		svr._onStop()
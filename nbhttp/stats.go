@@ -0,0 +1,157 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbhttp
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/nbio/taskpool"
+)
+
+// DefaultLatencyBuckets represents the default upper bounds in seconds of the request latency histogram.
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets with atomics.
+type Histogram struct {
+	count   uint64
+	sumBits uint64
+
+	buckets []float64
+	counts  []uint64
+}
+
+// HistogramSnapshot represents a snapshot of a Histogram, Counts are cumulative for each bucket.
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a snapshot of the Histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     math.Float64frombits(atomic.LoadUint64(&h.sumBits)),
+	}
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = n
+	}
+	return s
+}
+
+// NewHistogram creates a Histogram with sorted upper bounds.
+func NewHistogram(buckets []float64) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// ServerStats represents a snapshot of a Server's http statistics.
+type ServerStats struct {
+	Online int
+
+	// Requests represents the num of responses flushed.
+	Requests uint64
+	// StatusCodes represents the num of responses for each status code.
+	StatusCodes map[int]uint64
+	// Latency represents the time in seconds from a request parsed to its response flushed.
+	Latency HistogramSnapshot
+
+	// PendingRequests represents the num of requests waiting for the message handler or being handled.
+	PendingRequests int64
+
+	WebsocketMessagesRead    uint64
+	WebsocketMessagesWritten uint64
+
+	// MessageHandlerPool represents the stats of the Server's message handler pool,
+	// it's nil if the Server is created with a custom messageHandlerExecutor.
+	MessageHandlerPool *taskpool.Stats
+}
+
+type serverStats struct {
+	requests  uint64
+	pending   int64
+	wsRead    uint64
+	wsWritten uint64
+
+	statusCodes [600]uint64
+
+	latency *Histogram
+}
+
+func (s *serverStats) onResponse(statusCode int, latency time.Duration) {
+	atomic.AddUint64(&s.requests, 1)
+	if statusCode > 0 && statusCode < len(s.statusCodes) {
+		atomic.AddUint64(&s.statusCodes[statusCode], 1)
+	}
+	s.latency.Observe(latency.Seconds())
+}
+
+func newServerStats(latencyBuckets []float64) *serverStats {
+	if len(latencyBuckets) == 0 {
+		latencyBuckets = DefaultLatencyBuckets
+	}
+	return &serverStats{latency: NewHistogram(latencyBuckets)}
+}
+
+// AddWebsocketMessages is called by websocket.Conn to count text and binary messages.
+func (s *Server) AddWebsocketMessages(read, written int) {
+	if read > 0 {
+		atomic.AddUint64(&s.stats.wsRead, uint64(read))
+	}
+	if written > 0 {
+		atomic.AddUint64(&s.stats.wsWritten, uint64(written))
+	}
+}
+
+// HTTPStats returns a snapshot of the Server's http statistics, Stats returns the Gopher's.
+func (s *Server) HTTPStats() *ServerStats {
+	st := &ServerStats{
+		Online:                   s.Online(),
+		Requests:                 atomic.LoadUint64(&s.stats.requests),
+		StatusCodes:              map[int]uint64{},
+		Latency:                  s.stats.latency.Snapshot(),
+		PendingRequests:          atomic.LoadInt64(&s.stats.pending),
+		WebsocketMessagesRead:    atomic.LoadUint64(&s.stats.wsRead),
+		WebsocketMessagesWritten: atomic.LoadUint64(&s.stats.wsWritten),
+	}
+	if s.messageHandlerPool != nil {
+		ps := s.messageHandlerPool.Stats()
+		st.MessageHandlerPool = &ps
+	}
+	for code := range s.stats.statusCodes {
+		if n := atomic.LoadUint64(&s.stats.statusCodes[code]); n > 0 {
+			st.StatusCodes[code] = n
+		}
+	}
+	return st
+}
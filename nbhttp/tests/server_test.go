@@ -0,0 +1,117 @@
+// +build !unit
+
+package nbhttp
+
+import (
+	"bufio"
+	"bytes"
+	stockTLS "crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/llib/std/crypto/tls"
+	"github.com/lesismal/nbio/nbhttp"
+)
+
+func TestMaxPendingRequests(t *testing.T) {
+	addr := "127.0.0.1:8912"
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	svr := nbhttp.NewServer(nbhttp.Config{
+		Network:            "tcp",
+		Addrs:              []string{addr},
+		NPoller:            1,
+		MaxPendingRequests: 1,
+	}, mux, nil)
+	err := svr.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer svr.Stop()
+
+	for loop := 0; loop < 20; loop++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		const num = 500
+		reqs := &bytes.Buffer{}
+		for i := 0; i < num; i++ {
+			reqs.WriteString("GET /" + strings.Repeat("x", i%10) + " HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		}
+		go conn.Write(reqs.Bytes())
+
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		reader := bufio.NewReader(conn)
+		for i := 0; i < num; i++ {
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("ReadResponse %v failed: %v", i, err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil || string(body) != "/"+strings.Repeat("x", i%10) {
+				t.Fatalf("invalid response %v: %q, %v", i, body, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestServerTLSZeroCopy(t *testing.T) {
+	addr := "127.0.0.1:8914"
+	cert, err := tls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	if err != nil {
+		t.Fatalf("tls.X509KeyPair failed: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+
+	body := make([]byte, 1024*1024*4)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	svr := nbhttp.NewServerTLS(nbhttp.Config{
+		Network:           "tcp",
+		Addrs:             []string{addr},
+		ZeroCopyThreshold: 1,
+	}, mux, nil, tlsConfig)
+	err = svr.Start()
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer svr.Stop()
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			TLSClientConfig: &stockTLS.Config{InsecureSkipVerify: true},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		res, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("read body failed: %v", err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Fatalf("invalid body: %v, %v", len(data), len(body))
+		}
+	}
+}
@@ -44,6 +44,7 @@ type Conn struct {
 func (c *Conn) handleMessage(opcode int8, data []byte) {
 	switch opcode {
 	case TextMessage, BinaryMessage:
+		c.Server.AddWebsocketMessages(1, 0)
 		c.messageHandler(c, opcode, data)
 	case CloseMessage:
 		if len(data) >= 2 {
@@ -123,6 +124,10 @@ func (c *Conn) WriteMessage(messageType int8, data []byte) error {
 		data = data[n:]
 	}
 
+	if messageType == TextMessage || messageType == BinaryMessage {
+		c.Server.AddWebsocketMessages(0, 1)
+	}
+
 	return nil
 }
 
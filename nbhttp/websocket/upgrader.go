@@ -93,8 +93,13 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeade
 		if !ok {
 			return nil, u.returnError(w, r, http.StatusInternalServerError, err)
 		}
-		nbc, ok = tlsConn.Conn().(*nbio.Conn)
-		if !ok {
+		switch c := tlsConn.Conn().(type) {
+		case *nbio.Conn:
+			nbc = c
+		case interface{ NBConn() *nbio.Conn }:
+			// wrapped by nbhttp.NewServerTLS
+			nbc = c.NBConn()
+		default:
 			return nil, u.returnError(w, r, http.StatusInternalServerError, err)
 		}
 	}
@@ -1,6 +1,7 @@
 package nbio
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"log"
@@ -125,119 +126,1342 @@ func TestEcho(t *testing.T) {
 	<-done
 }
 
+func TestWritev(t *testing.T) {
+	wvAddr := "127.0.0.1:8902"
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{wvAddr},
+	})
+
+	// more than IOV_MAX buffers, and enough data to fill the kernel's sendQ
+	var buffers [][]byte
+	var expected []byte
+	for i := 0; i < 3000; i++ {
+		size := i % 7
+		if i%500 == 0 {
+			size = 1024 * 1024
+		}
+		b := make([]byte, size)
+		for j := range b {
+			b[j] = byte(i + j)
+		}
+		buffers = append(buffers, b)
+		expected = append(expected, b...)
+	}
+	var released int32
+	g.OnWriteBufferRelease(func(c *Conn, b []byte) {
+		atomic.AddInt32(&released, 1)
+	})
+	g.OnOpen(func(c *Conn) {
+		// write half of the buffers before the fd is added, and the others after
+		half := len(buffers) / 2
+		c.Writev(buffers[:half])
+		time.AfterFunc(time.Second/10, func() {
+			c.Writev(buffers[half:])
+		})
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", wvAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data := make([]byte, len(expected))
+	if _, err = io.ReadFull(conn, data); err != nil {
+		log.Panicf("read failed: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		log.Panicf("invalid data")
+	}
+	time.Sleep(time.Second / 10)
+	// the rest of a buffer partially written is copied and released again
+	if n := atomic.LoadInt32(&released); n < int32(len(buffers)) {
+		log.Panicf("invalid released num: %v", n)
+	}
+}
+
 func TestSendfile(t *testing.T) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		panic(err)
+		panic(err)
+	}
+
+	buf := make([]byte, 1024*100)
+
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte("sendfile")); err != nil {
+			log.Panicf("write 'sendfile' failed: %v", err)
+		}
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			log.Panicf("read file failed: %v", err)
+		}
+	}
+}
+
+func TestSendfileRange(t *testing.T) {
+	srAddr := "127.0.0.1:8906"
+	f, err := ioutil.TempFile("", "nbio_sendfile")
+	if err != nil {
+		log.Panicf("TempFile failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	content := make([]byte, 1024*1024*8)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	if _, err := f.Write(content); err != nil {
+		log.Panicf("write file failed: %v", err)
+	}
+
+	var expected []byte
+	expected = append(expected, "head"...)
+	expected = append(expected, content[100:100+1024*1024*3]...)
+	expected = append(expected, "mid"...)
+	expected = append(expected, content[1024*1024*5:]...)
+	expected = append(expected, "tail"...)
+
+	chDone := make(chan int64, 2)
+	done := func(c *Conn, n int64, err error) {
+		if err != nil {
+			log.Panicf("SendfileRange failed: %v", err)
+		}
+		chDone <- n
+	}
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{srAddr},
+	})
+	g.OnOpen(func(c *Conn) {
+		c.Write([]byte("head"))
+		if err := c.SendfileRange(f, 100, 1024*1024*3, done); err != nil {
+			log.Panicf("SendfileRange failed: %v", err)
+		}
+		c.Write([]byte("mid"))
+		if err := c.SendfileRange(f, 1024*1024*5, 0, done); err != nil {
+			log.Panicf("SendfileRange failed: %v", err)
+		}
+		c.Write([]byte("tail"))
+	})
+	err = g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", srAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	// let the kernel's sendQ be full before reading
+	time.Sleep(time.Second / 10)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data := make([]byte, len(expected))
+	if _, err = io.ReadFull(conn, data); err != nil {
+		log.Panicf("read failed: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		log.Panicf("invalid data")
+	}
+	for _, size := range []int64{1024 * 1024 * 3, 1024 * 1024 * 3} {
+		select {
+		case n := <-chDone:
+			if n != size {
+				log.Panicf("invalid sent size: %v", n)
+			}
+		case <-time.After(time.Second):
+			log.Panicf("SendfileRange done not called")
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	g := NewGopher(Config{})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v\n", err)
+	}
+	defer g.Stop()
+
+	var done = make(chan int)
+	var begin time.Time
+	var timeout = time.Second
+	g.OnOpen(func(c *Conn) {
+		begin = time.Now()
+		c.SetReadDeadline(begin.Add(timeout))
+	})
+	g.OnClose(func(c *Conn, err error) {
+		to := time.Since(begin)
+		if to > timeout*2 {
+			log.Panicf("timeout: %v, want: %v", to, timeout)
+		}
+		close(done)
+	})
+
+	one := func() {
+		c, err := DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		g.AddConn(c)
+	}
+	one()
+
+	<-done
+}
+
+func TestReadTimeoutHandler(t *testing.T) {
+	toAddr := "127.0.0.1:8900"
+	timeout := time.Second / 10
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{toAddr},
+	})
+	g.OnOpen(func(c *Conn) {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	})
+	var timeouts int32
+	g.OnReadTimeout(func(c *Conn) {
+		if atomic.AddInt32(&timeouts, 1) == 1 {
+			c.Write([]byte("ping"))
+			c.SetReadDeadline(time.Now().Add(timeout))
+			return
+		}
+		c.Close()
+	})
+	chClose := make(chan error, 1)
+	g.OnClose(func(c *Conn, err error) {
+		chClose <- err
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", toAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		log.Panicf("read ping failed: %v, %v", err, string(buf))
+	}
+	select {
+	case err := <-chClose:
+		if err != nil {
+			log.Panicf("invalid close error: %v", err)
+		}
+	case <-time.After(time.Second):
+		log.Panicf("conn not closed by handler")
+	}
+	if n := atomic.LoadInt32(&timeouts); n != 2 {
+		log.Panicf("invalid timeouts: %v", n)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	hcAddr := "127.0.0.1:8901"
+	total := 1024 * 1024 * 4
+	chReply := make(chan string, 1)
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{hcAddr},
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		switch string(data) {
+		case "hello":
+			c.Write(append([]byte{}, data...))
+		case "flush":
+			c.Write(make([]byte, total))
+			if err := c.CloseWrite(); err != nil {
+				log.Panicf("CloseWrite failed: %v", err)
+			}
+			if _, err := c.Write([]byte("x")); err == nil {
+				log.Panicf("Write after CloseWrite should fail")
+			}
+		case "ask":
+			c.Write([]byte("answer"))
+			c.CloseWrite()
+		default:
+			chReply <- string(data)
+		}
+	})
+	g.OnHalfClose(func(c *Conn) {
+		c.Write([]byte("bye"))
+		c.CloseWrite()
+	})
+	chClose := make(chan error, 2)
+	g.OnClose(func(c *Conn, err error) {
+		chClose <- err
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	// the peer shuts down writing first
+	conn, err := net.Dial("tcp", hcAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		log.Panicf("read hello failed: %v, %v", err, string(buf))
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "bye" {
+		log.Panicf("read bye failed: %v, %v", err, string(data))
+	}
+	if err = <-chClose; err != nil {
+		log.Panicf("invalid close error: %v", err)
+	}
+
+	// nbio shuts down writing first, after the data buffered is flushed
+	conn2, err := net.Dial("tcp", hcAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(time.Second * 2))
+	conn2.Write([]byte("flush"))
+	data, err = io.ReadAll(conn2)
+	if err != nil || len(data) != total {
+		log.Panicf("read all failed: %v, %v", err, len(data))
+	}
+	conn2.(*net.TCPConn).CloseWrite()
+	if err = <-chClose; err != io.EOF {
+		log.Panicf("invalid close error: %v", err)
+	}
+
+	// nbio shuts down writing first, then the peer replies and closes, the reply arrives with the FIN
+	for i := 0; i < 5; i++ {
+		conn3, err := net.Dial("tcp", hcAddr)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		conn3.SetReadDeadline(time.Now().Add(time.Second * 2))
+		conn3.Write([]byte("ask"))
+		data, err = io.ReadAll(conn3)
+		if err != nil || string(data) != "answer" {
+			log.Panicf("read answer failed: %v, %v", err, string(data))
+		}
+		conn3.Write([]byte("reply"))
+		conn3.Close()
+		if err = <-chClose; err != io.EOF {
+			log.Panicf("invalid close error: %v", err)
+		}
+		select {
+		case s := <-chReply:
+			if s != "reply" {
+				log.Panicf("invalid reply: %v", s)
+			}
+		default:
+			log.Panicf("reply lost")
+		}
+	}
+}
+
+func TestFuzz(t *testing.T) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			if idx%2 == 0 {
+				Dial("tcp4", addr)
+			} else {
+				Dial("tcp4", addr)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	readed := 0
+	wg2 := sync.WaitGroup{}
+	wg2.Add(1)
+	g := NewGopher(Config{NPoller: 1})
+	g.OnData(func(c *Conn, data []byte) {
+		readed += len(data)
+		if readed == 4 {
+			wg2.Done()
+		}
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+
+	c, err := Dial("tcp", addr)
+	if err == nil {
+		log.Printf("Dial tcp4: %v, %v, %v", c.LocalAddr(), c.RemoteAddr(), err)
+		g.AddConn(c)
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.Write([]byte{1})
+
+		time.Sleep(time.Second / 10)
+
+		bs := [][]byte{}
+		bs = append(bs, []byte{2})
+		bs = append(bs, []byte{3})
+		bs = append(bs, []byte{4})
+		c.Writev(bs)
+
+		time.Sleep(time.Second / 10)
+
+		c.Close()
+		c.Write([]byte{1})
+	} else {
+		log.Panicf("Dial tcp4: %v", err)
+	}
+
+	gErr := NewGopher(Config{
+		Network: "tcp4",
+		Addrs:   []string{"127.0.0.1:8889", "127.0.0.1:8889"},
+	})
+	gErr.Start()
+}
+
+func TestUDP(t *testing.T) {
+	udpAddr := "127.0.0.1:8890"
+	g := NewGopher(Config{
+		Network:        "udp",
+		Addrs:          []string{udpAddr},
+		UDPVirtualConn: true,
+		UDPReadTimeout: time.Second / 5,
+	})
+
+	var opened, closed int32
+	chClosed := make(chan struct{})
+	g.OnOpen(func(c *Conn) {
+		atomic.AddInt32(&opened, 1)
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		if _, ok := c.RemoteAddr().(*net.UDPAddr); !ok {
+			log.Panicf("invalid remote addr: %v", c.RemoteAddr())
+		}
+		c.Write(append([]byte{}, data...))
+	})
+	g.OnClose(func(c *Conn, err error) {
+		if atomic.AddInt32(&closed, 1) == 1 {
+			close(chClosed)
+		}
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("udp", udpAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			log.Panicf("Write failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			log.Panicf("Read failed: %v, %v", string(buf[:n]), err)
+		}
+	}
+	if atomic.LoadInt32(&opened) != 1 {
+		log.Panicf("invalid opened num: %v", opened)
+	}
+
+	select {
+	case <-chClosed:
+	case <-time.After(time.Second * 2):
+		log.Panicf("udp virtual conn idle timeout failed")
+	}
+}
+
+func TestUnix(t *testing.T) {
+	unixAddr := "nbio_test.sock"
+	os.Remove(unixAddr)
+
+	g := NewGopher(Config{
+		Network: "unix",
+		Addrs:   []string{unixAddr},
+	})
+	g.OnOpen(func(c *Conn) {
+		if _, ok := c.RemoteAddr().(*net.UnixAddr); !ok {
+			log.Panicf("invalid remote addr: %v", c.RemoteAddr())
+		}
+		if err := c.SetNoDelay(true); err != nil {
+			log.Panicf("SetNoDelay failed: %v", err)
+		}
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		c.Write(append([]byte{}, data...))
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	c, err := Dial("unix", unixAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	if _, ok := c.LocalAddr().(*net.UnixAddr); !ok {
+		log.Panicf("invalid local addr: %v", c.LocalAddr())
+	}
+
+	done := make(chan struct{})
+	gc := NewGopher(Config{})
+	gc.OnData(func(c *Conn, data []byte) {
+		if string(data) == "hello" {
+			close(done)
+		}
+	})
+	if err := gc.Start(); err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer gc.Stop()
+	gc.AddConn(c)
+	c.Write([]byte("hello"))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		log.Panicf("unix echo timeout")
+	}
+}
+
+func TestDialAsync(t *testing.T) {
+	g := NewGopher(Config{})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	var opened int32
+	done := make(chan struct{})
+	g.OnOpen(func(c *Conn) {
+		atomic.AddInt32(&opened, 1)
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		if string(data) == "hello" {
+			close(done)
+		}
+	})
+
+	g.DialAsync("tcp", addr, time.Second, func(c *Conn, err error) {
+		if err != nil {
+			log.Panicf("DialAsync failed: %v", err)
+		}
+		if atomic.LoadInt32(&opened) != 1 {
+			log.Panicf("OnOpen not called before dial handler")
+		}
+		c.Write([]byte("hello"))
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		log.Panicf("DialAsync echo timeout")
+	}
+
+	chErr := make(chan error, 1)
+	g.DialAsync("tcp", "127.0.0.1:1", time.Second, func(c *Conn, err error) {
+		chErr <- err
+	})
+	select {
+	case err := <-chErr:
+		if err == nil {
+			log.Panicf("DialAsync to a closed port should fail")
+		}
+	case <-time.After(time.Second * 2):
+		log.Panicf("DialAsync failure not reported")
+	}
+}
+
+func TestReconnectConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Panicf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	chData := make(chan string, 4)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				conn.Close()
+				continue
+			}
+			go func() {
+				buf := make([]byte, 64)
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, _ := io.ReadAtLeast(conn, buf, len("hello world"))
+				chData <- string(buf[:n])
+				conn.Close()
+			}()
+		}
+	}()
+
+	g := NewGopher(Config{})
+	err = g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	var connected, disconnected int32
+	rc := g.NewReconnectConn(ReconnectConfig{
+		Network:         "tcp",
+		Addr:            ln.Addr().String(),
+		MinBackoff:      time.Millisecond * 10,
+		MaxBackoff:      time.Millisecond * 50,
+		Jitter:          0.2,
+		MaxBufferedSize: 64,
+	})
+	rc.OnConnected(func(c *Conn) {
+		if atomic.AddInt32(&connected, 1) == 2 {
+			// written after the data buffered while disconnected
+			rc.Write([]byte(" world"))
+		}
+	})
+	rc.OnDisconnected(func(c *Conn, err error) {
+		if atomic.AddInt32(&disconnected, 1) == 1 {
+			if _, err := rc.Write([]byte("hello")); err != nil {
+				log.Panicf("buffered Write failed: %v", err)
+			}
+		}
+	})
+
+	if _, err := rc.Write(make([]byte, 65)); err == nil {
+		log.Panicf("buffered Write should overflow")
+	}
+	rc.Start()
+
+	select {
+	case data := <-chData:
+		if data != "hello world" {
+			log.Panicf("invalid buffered data: %v", data)
+		}
+	case <-time.After(time.Second * 2):
+		log.Panicf("reconnect timeout")
+	}
+	if atomic.LoadInt32(&connected) < 2 || atomic.LoadInt32(&disconnected) < 1 {
+		log.Panicf("invalid connected/disconnected num: %v, %v", connected, disconnected)
+	}
+
+	rc.Close()
+	if rc.Conn() != nil {
+		log.Panicf("Conn should be nil after Close")
+	}
+	if _, err := rc.Write([]byte("hello")); err == nil {
+		log.Panicf("Write should fail after Close")
+	}
+}
+
+func TestPauseRead(t *testing.T) {
+	pauseAddr := "127.0.0.1:8891"
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{pauseAddr},
+	})
+	chConn := make(chan *Conn, 1)
+	chData := make(chan []byte, 4)
+	g.OnOpen(func(c *Conn) {
+		if err := c.PauseRead(); err != nil {
+			log.Panicf("PauseRead failed: %v", err)
+		}
+		chConn <- c
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		chData <- append([]byte{}, data...)
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", pauseAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+
+	c := <-chConn
+	select {
+	case <-chData:
+		log.Panicf("data received while reading paused")
+	case <-time.After(time.Second / 5):
+	}
+	if !c.IsReadPaused() {
+		log.Panicf("IsReadPaused should be true")
+	}
+
+	if err := c.ResumeRead(); err != nil {
+		log.Panicf("ResumeRead failed: %v", err)
+	}
+	select {
+	case data := <-chData:
+		if string(data) != "hello" {
+			log.Panicf("invalid data: %v", string(data))
+		}
+	case <-time.After(time.Second):
+		log.Panicf("no data received after ResumeRead")
+	}
+}
+
+func TestWriteBufferWatermark(t *testing.T) {
+	wmAddr := "127.0.0.1:8892"
+	total := 1024 * 1024 * 8
+	g := NewGopher(Config{
+		Network:                  "tcp",
+		Addrs:                    []string{wmAddr},
+		WriteBufferHighWatermark: 1024 * 256,
+		WriteBufferLowWatermark:  1024 * 16,
+	})
+	chHigh := make(chan int, 1)
+	chLow := make(chan int, 1)
+	g.OnOpen(func(c *Conn) {
+		c.SetWriteBuffer(1024 * 16)
+		for i := 0; i < total; i += 1024 * 64 {
+			c.Write(make([]byte, 1024*64))
+		}
+	})
+	g.OnWriteBufferHigh(func(c *Conn, size int) {
+		if size != c.BufferedWriteSize() {
+			log.Panicf("invalid buffered size: %v, %v", size, c.BufferedWriteSize())
+		}
+		chHigh <- size
+	})
+	g.OnWriteBufferLow(func(c *Conn, size int) {
+		chLow <- size
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", wmAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case size := <-chHigh:
+		if size < 1024*256 {
+			log.Panicf("invalid high watermark size: %v", size)
+		}
+	case <-time.After(time.Second):
+		log.Panicf("OnWriteBufferHigh not called")
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, total)); err != nil {
+		log.Panicf("ReadFull failed: %v", err)
+	}
+	select {
+	case size := <-chLow:
+		if size > 1024*16 {
+			log.Panicf("invalid low watermark size: %v", size)
+		}
+	case <-time.After(time.Second):
+		log.Panicf("OnWriteBufferLow not called")
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	rpAddr := "127.0.0.1:8893"
+	g := NewGopher(Config{
+		Network:   "tcp",
+		Addrs:     []string{rpAddr},
+		NListener: 4,
+		ReusePort: true,
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		c.Write(append([]byte{}, data...))
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	if len(g.listeners) != 4 {
+		log.Panicf("invalid listener num: %v", len(g.listeners))
+	}
+
+	buf := make([]byte, 5)
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("tcp", rpAddr)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		conn.Write([]byte("hello"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			log.Panicf("echo failed: %v, %v", string(buf), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	hoAddr := "127.0.0.1:8894"
+	hoPath := "nbio_handoff_test.sock"
+	defer os.Remove(hoPath)
+
+	gOld := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{hoAddr},
+	})
+	gOld.OnData(func(c *Conn, data []byte) {
+		c.Write([]byte("old"))
+	})
+	err := gOld.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer gOld.Stop()
+
+	idleConn, err := net.Dial("tcp", hoAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer idleConn.Close()
+	buf := make([]byte, 3)
+	idleConn.Write([]byte("x"))
+	if _, err := io.ReadFull(idleConn, buf); err != nil || string(buf) != "old" {
+		log.Panicf("read failed: %v, %v", string(buf), err)
+	}
+
+	gNew := NewGopher(Config{HandoffPath: hoPath})
+	gNew.OnData(func(c *Conn, data []byte) {
+		c.Write([]byte("new"))
+	})
+	chStarted := make(chan error, 1)
+	go func() {
+		chStarted <- gNew.Start()
+	}()
+
+	err = gOld.ServeHandoff(hoPath, time.Second*5, func(c *Conn) bool { return true })
+	if err != nil {
+		log.Panicf("ServeHandoff failed: %v", err)
+	}
+	if err = <-chStarted; err != nil {
+		log.Panicf("Start with handoff failed: %v", err)
+	}
+	defer gNew.Stop()
+
+	for _, conn := range []net.Conn{idleConn, nil} {
+		if conn == nil {
+			conn, err = net.Dial("tcp", hoAddr)
+			if err != nil {
+				log.Panicf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+		}
+		conn.Write([]byte("x"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "new" {
+			log.Panicf("read after handoff failed: %v, %v", string(buf), err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	statsAddr := "127.0.0.1:8897"
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{statsAddr},
+		NPoller: 2,
+	})
+	chClosed := make(chan *ConnStats, 1)
+	g.OnData(func(c *Conn, data []byte) {
+		c.Write(append([]byte{}, data...))
+	})
+	g.OnClose(func(c *Conn, err error) {
+		chClosed <- c.Stats()
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
 	}
+	defer g.Stop()
 
-	buf := make([]byte, 1024*100)
-
-	for i := 0; i < 3; i++ {
-		if _, err := conn.Write([]byte("sendfile")); err != nil {
-			log.Panicf("write 'sendfile' failed: %v", err)
-		}
+	conn, err := net.Dial("tcp", statsAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		log.Panicf("read failed: %v", err)
+	}
+	if s := g.Stats(); s.Online != 1 || s.Accepted != 1 || len(s.PollerConns) != 2 {
+		log.Panicf("invalid gopher stats: %+v", s)
+	}
+	conn.Close()
 
-		if _, err := io.ReadFull(conn, buf); err != nil {
-			log.Panicf("read file failed: %v", err)
-		}
+	cs := <-chClosed
+	if cs.BytesRead != 5 || cs.BytesWritten != 5 || cs.CreatedAt.IsZero() || cs.LastRead.IsZero() || cs.LastWrite.IsZero() {
+		log.Panicf("invalid conn stats: %+v", cs)
+	}
+	s := g.Stats()
+	if s.Online != 0 || s.Closed != 1 || s.ClosedByReason[CloseReasonEOF] != 1 || s.BytesRead != 5 || s.BytesWritten != 5 || s.PendingWriteBytes != 0 {
+		log.Panicf("invalid gopher stats: %+v", s)
 	}
 }
 
-func TestTimeout(t *testing.T) {
-	g := NewGopher(Config{})
+func TestIdleTimeout(t *testing.T) {
+	idleAddr := "127.0.0.1:8899"
+	idleTimeout := time.Second / 5
+	g := NewGopher(Config{
+		Network:     "tcp",
+		Addrs:       []string{idleAddr},
+		IdleTimeout: idleTimeout,
+	})
+	chClose := make(chan string, 3)
+	g.OnClose(func(c *Conn, err error) {
+		if err != ErrIdleTimeout {
+			log.Panicf("invalid close error: %v", err)
+		}
+		chClose <- c.RemoteAddr().String()
+	})
 	err := g.Start()
 	if err != nil {
-		log.Panicf("Start failed: %v\n", err)
+		log.Panicf("Start failed: %v", err)
 	}
 	defer g.Stop()
 
-	var done = make(chan int)
-	var begin time.Time
-	var timeout = time.Second
-	g.OnOpen(func(c *Conn) {
-		begin = time.Now()
-		c.SetReadDeadline(begin.Add(timeout))
+	t1 := time.Now()
+	idle, err := net.Dial("tcp", idleAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer idle.Close()
+	active, err := net.Dial("tcp", idleAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer active.Close()
+
+	for i := 0; i < 6; i++ {
+		active.Write([]byte("hello"))
+		time.Sleep(idleTimeout / 2)
+	}
+	select {
+	case addr := <-chClose:
+		if addr != idle.LocalAddr().String() {
+			log.Panicf("active conn closed")
+		}
+		if d := time.Since(t1); d < idleTimeout {
+			log.Panicf("closed too early: %v", d)
+		}
+	default:
+		log.Panicf("idle conn not closed")
+	}
+	select {
+	case <-chClose:
+		log.Panicf("active conn closed")
+	default:
+	}
+
+	select {
+	case addr := <-chClose:
+		if addr != active.LocalAddr().String() {
+			log.Panicf("invalid conn closed")
+		}
+	case <-time.After(idleTimeout * 3):
+		log.Panicf("active conn not closed after idle")
+	}
+	if n := g.Stats().ClosedByReason[CloseReasonIdle]; n != 2 {
+		log.Panicf("invalid idle closed num: %v", n)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(&Config{AcceptRatePerIP: 1, AcceptBurstPerIP: 2, IPv4PrefixLen: 24, AcceptRate: 1, AcceptBurst: 3})
+	src1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	src2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}
+	src3 := &net.TCPAddr{IP: net.ParseIP("10.0.1.1")}
+	for i, v := range []struct {
+		addr net.Addr
+		err  error
+	}{
+		{src1, nil},
+		{src2, nil},
+		// the same /24 as src1
+		{src2, ErrAcceptRate},
+		{src3, nil},
+		// global
+		{src3, ErrAcceptRate},
+	} {
+		if _, err := a.admit(v.addr); err != v.err {
+			log.Panicf("admit %v failed: %v, %v", i, err, v.err)
+		}
+	}
+	// src3's token taken by the conn rejected by the global limit is refunded
+	if tokens := a.sources[a.sourceKey(src3)].bucket.tokens; tokens < 1 {
+		log.Panicf("source charged for global rejection: %v", tokens)
+	}
+
+	acAddr := "127.0.0.1:8907"
+	g := NewGopher(Config{
+		Network:       "tcp",
+		Addrs:         []string{acAddr},
+		MaxConnsPerIP: 2,
+	})
+	chReject := make(chan error, 1)
+	chClose := make(chan struct{}, 3)
+	g.OnReject(func(conn net.Conn, err error) {
+		conn.Write([]byte("busy"))
+		chReject <- err
 	})
 	g.OnClose(func(c *Conn, err error) {
-		to := time.Since(begin)
-		if to > timeout*2 {
-			log.Panicf("timeout: %v, want: %v", to, timeout)
-		}
-		close(done)
+		chClose <- struct{}{}
 	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
 
-	one := func() {
-		c, err := DialTimeout("tcp", addr, time.Second)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", acAddr)
 		if err != nil {
 			log.Panicf("Dial failed: %v", err)
 		}
-		g.AddConn(c)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	select {
+	case err := <-chReject:
+		if err != ErrTooManyConns {
+			log.Panicf("invalid reject error: %v", err)
+		}
+	case <-time.After(time.Second):
+		log.Panicf("OnReject not called")
+	}
+	conns[2].SetReadDeadline(time.Now().Add(time.Second))
+	if data, err := ioutil.ReadAll(conns[2]); err != nil || string(data) != "busy" {
+		log.Panicf("invalid rejected conn: %v, %v", string(data), err)
+	}
+	if n := g.Stats().Rejected; n != 1 {
+		log.Panicf("invalid rejected num: %v", n)
 	}
-	one()
 
-	<-done
+	// a new conn is accepted after one of the source's conns is closed
+	conns[0].Close()
+	<-chClose
+	conn, err := net.Dial("tcp", acAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-chReject:
+		log.Panicf("conn rejected: %v", err)
+	case <-time.After(time.Second / 10):
+	}
 }
 
-func TestFuzz(t *testing.T) {
-	wg := sync.WaitGroup{}
-	for i := 0; i < 100; i++ {
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			if idx%2 == 0 {
-				Dial("tcp4", addr)
-			} else {
-				Dial("tcp4", addr)
+func TestCIDRFilter(t *testing.T) {
+	if err := NewGopher(Config{AllowCIDRs: []string{"10.0.0.0/33"}}).Start(); err == nil {
+		log.Panicf("invalid CIDR accepted")
+	}
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}
+	f := &cidrFilter{}
+	for i, v := range []struct {
+		allow  []string
+		deny   []string
+		accept bool
+	}{
+		{nil, nil, true},
+		{[]string{"10.0.0.0/8"}, nil, true},
+		{[]string{"192.168.0.0/16", "::1"}, nil, false},
+		{[]string{"10.0.0.0/8"}, []string{"10.1.2.3"}, false},
+		{nil, []string{"10.2.0.0/16"}, true},
+	} {
+		var err error
+		if f.allow, err = parseCIDRs(v.allow); err != nil {
+			log.Panicf("parseCIDRs failed: %v", err)
+		}
+		if f.deny, err = parseCIDRs(v.deny); err != nil {
+			log.Panicf("parseCIDRs failed: %v", err)
+		}
+		if f.accept(src) != v.accept {
+			log.Panicf("filter %v failed", i)
+		}
+	}
+
+	fAddr := "127.0.0.1:8908"
+	g := NewGopher(Config{
+		Network:   "tcp",
+		Addrs:     []string{fAddr},
+		DenyCIDRs: []string{"127.0.0.0/8"},
+	})
+	chReject := make(chan error, 4)
+	g.OnReject(func(conn net.Conn, err error) {
+		chReject <- err
+	})
+	var denyAll int32
+	g.OnAccept(func(remote net.Addr) bool {
+		return atomic.LoadInt32(&denyAll) == 0
+	})
+	chAccept := make(chan struct{}, 4)
+	g.OnOpen(func(c *Conn) {
+		chAccept <- struct{}{}
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	dial := func(accepted bool) {
+		conn, err := net.Dial("tcp", fAddr)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		select {
+		case err := <-chReject:
+			if accepted || err != ErrDenied {
+				log.Panicf("invalid reject: %v", err)
 			}
-		}(i)
+		case <-chAccept:
+			if !accepted {
+				log.Panicf("conn not rejected")
+			}
+		case <-time.After(time.Second):
+			log.Panicf("conn not handled")
+		}
 	}
+	dial(false)
+	if err := g.SetCIDRFilter([]string{"127.0.0.1"}, nil); err != nil {
+		log.Panicf("SetCIDRFilter failed: %v", err)
+	}
+	dial(true)
+	atomic.StoreInt32(&denyAll, 1)
+	dial(false)
+}
 
-	wg.Wait()
+func TestProxyProtocol(t *testing.T) {
+	for _, h := range []*ProxyHeader{
+		{Version: 1, SourceAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}, DestinationAddr: &net.TCPAddr{IP: net.ParseIP("::2"), Port: 2}},
+		{Version: 1, Local: true},
+		{Version: 2, SourceAddr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1}, DestinationAddr: &net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 2}},
+		{Version: 2, SourceAddr: &net.UnixAddr{Name: "/a", Net: "unix"}, DestinationAddr: &net.UnixAddr{Name: "/b", Net: "unix"},
+			TLVs: []ProxyTLV{{Type: ProxyTLVUniqueID, Value: []byte("id")}, {Type: ProxyTLVNoop}}},
+	} {
+		b, err := h.Encode()
+		if err != nil {
+			log.Panicf("Encode failed: %v", err)
+		}
+		for i := 0; i < len(b); i++ {
+			if h2, _, err := parseProxyHeader(b[:i]); h2 != nil || err != nil {
+				log.Panicf("partial header parsed: %v, %v", h2, err)
+			}
+		}
+		h2, n, err := parseProxyHeader(append(b, "data"...))
+		if err != nil || n != len(b) {
+			log.Panicf("parseProxyHeader failed: %v, %v", n, err)
+		}
+		b2, _ := h2.Encode()
+		if !bytes.Equal(b, b2) {
+			log.Panicf("invalid header parsed: %q, %q", b, b2)
+		}
+	}
 
-	readed := 0
-	wg2 := sync.WaitGroup{}
-	wg2.Add(1)
-	g := NewGopher(Config{NPoller: 1})
+	pAddr := "127.0.0.1:8909"
+	g := NewGopher(Config{
+		Network:              "tcp",
+		Addrs:                []string{pAddr},
+		ProxyProtocol:        true,
+		ProxyProtocolTimeout: time.Second / 5,
+	})
+	chOpen := make(chan *Conn, 4)
+	chData := make(chan []byte, 4)
+	g.OnOpen(func(c *Conn) {
+		if c.ProxyHeader() != nil {
+			chOpen <- c
+		}
+	})
 	g.OnData(func(c *Conn, data []byte) {
-		readed += len(data)
-		if readed == 4 {
-			wg2.Done()
+		if c.ProxyHeader() != nil {
+			c.Write(append([]byte{}, data...))
+		} else {
+			chData <- append([]byte{}, data...)
 		}
 	})
 	err := g.Start()
 	if err != nil {
 		log.Panicf("Start failed: %v", err)
 	}
+	defer g.Stop()
 
-	c, err := Dial("tcp", addr)
-	if err == nil {
-		log.Printf("Dial tcp4: %v, %v, %v", c.LocalAddr(), c.RemoteAddr(), err)
-		g.AddConn(c)
-		c.SetWriteDeadline(time.Now().Add(time.Second))
-		c.Write([]byte{1})
+	// v2 header with TLVs written by a Conn dialed
+	c, err := Dial("tcp", pAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	g.AddConn(c)
+	defer c.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5678}
+	err = c.WriteProxyHeader(&ProxyHeader{
+		Version:         2,
+		SourceAddr:      src,
+		DestinationAddr: &net.TCPAddr{IP: net.ParseIP("10.4.5.6"), Port: 80},
+		TLVs:            []ProxyTLV{{Type: ProxyTLVAuthority, Value: []byte("example.com")}},
+	})
+	if err != nil {
+		log.Panicf("WriteProxyHeader failed: %v", err)
+	}
+	c.Write([]byte("hello"))
+	select {
+	case sc := <-chOpen:
+		if sc.RemoteAddr().String() != src.String() || sc.LocalAddr().String() != "10.4.5.6:80" {
+			log.Panicf("invalid addrs: %v, %v", sc.RemoteAddr(), sc.LocalAddr())
+		}
+		if v, ok := sc.ProxyHeader().TLV(ProxyTLVAuthority); !ok || string(v) != "example.com" {
+			log.Panicf("invalid tlv: %q", v)
+		}
+	case <-time.After(time.Second):
+		log.Panicf("OnOpen not called")
+	}
+	select {
+	case data := <-chData:
+		if string(data) != "hello" {
+			log.Panicf("invalid data: %q", data)
+		}
+	case <-time.After(time.Second):
+		log.Panicf("data not echoed")
+	}
 
-		time.Sleep(time.Second / 10)
+	// v1 header split into pieces
+	conn, err := net.Dial("tcp", pAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 10.1.2.3 10.4.5.6 "))
+	time.Sleep(time.Second / 20)
+	conn.Write([]byte("5678 80\r\nhello"))
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		log.Panicf("read echo failed: %q, %v", buf, err)
+	}
+	if sc := <-chOpen; sc.RemoteAddr().String() != src.String() {
+		log.Panicf("invalid remote addr: %v", sc.RemoteAddr())
+	}
 
-		bs := [][]byte{}
-		bs = append(bs, []byte{2})
-		bs = append(bs, []byte{3})
-		bs = append(bs, []byte{4})
-		c.Writev(bs)
+	// without a valid header, or without any data
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", ""} {
+		conn, err := net.Dial("tcp", pAddr)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		conn.Write([]byte(data))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); err != io.EOF {
+			log.Panicf("conn not closed: %v", err)
+		}
+		conn.Close()
+	}
+	if len(chOpen) > 0 {
+		log.Panicf("OnOpen called without a valid header")
+	}
+}
 
-		time.Sleep(time.Second / 10)
+func TestRateLimit(t *testing.T) {
+	const rate = 1024 * 1024
+	const size = 1024 * 400
+	rAddr := "127.0.0.1:8910"
+	g := NewGopher(Config{
+		Network:        "tcp",
+		Addrs:          []string{rAddr},
+		ConnReadRate:   rate,
+		ConnReadBurst:  1024 * 16,
+		ConnWriteRate:  rate,
+		ConnWriteBurst: 1024 * 16,
+	})
+	var unlimited int32
+	g.OnOpen(func(c *Conn) {
+		if atomic.LoadInt32(&unlimited) == 1 {
+			c.SetRateLimit(0, 0)
+		}
+		c.Write(make([]byte, size))
+	})
+	var nread int64
+	chRead := make(chan struct{}, 1)
+	g.OnData(func(c *Conn, data []byte) {
+		if atomic.AddInt64(&nread, int64(len(data))) == size {
+			chRead <- struct{}{}
+		}
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
 
-		c.Close()
-		c.Write([]byte{1})
-	} else {
-		log.Panicf("Dial tcp4: %v", err)
+	transfer := func() time.Duration {
+		atomic.StoreInt64(&nread, 0)
+		conn, err := net.Dial("tcp", rAddr)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		begin := time.Now()
+		go conn.Write(make([]byte, size))
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+			log.Panicf("read failed: %v", err)
+		}
+		select {
+		case <-chRead:
+		case <-time.After(time.Second * 5):
+			log.Panicf("data not read")
+		}
+		return time.Since(begin)
 	}
 
-	gErr := NewGopher(Config{
-		Network: "tcp4",
-		Addrs:   []string{"127.0.0.1:8889", "127.0.0.1:8889"},
-	})
-	gErr.Start()
+	// about 0.4s for both directions at 1m/s
+	if used := transfer(); used < time.Second/4 {
+		log.Panicf("rate not limited: %v", used)
+	}
+	atomic.StoreInt32(&unlimited, 1)
+	if used := transfer(); used > time.Second/4 {
+		log.Panicf("rate limit not disabled: %v", used)
+	}
 }
 
 func TestHeapTimer(t *testing.T) {
@@ -360,6 +1584,97 @@ LOOP_RECV:
 	it.Stop()
 }
 
+func TestTimerWheel(t *testing.T) {
+	g := NewGopher(Config{NPoller: 2, TimerWheel: true, TimerWheelTick: time.Millisecond * 5})
+	g.Start()
+	defer g.Stop()
+
+	timeout := time.Second / 10
+
+	testHeapTimerNormal(g, t, timeout)
+	testHeapTimerExecPanic(g, t, timeout)
+	testHeapTimerNormalExecMany(g, t, timeout)
+
+	// more than 256 ticks, cascaded from the second level
+	t1 := time.Now()
+	ch1 := make(chan int)
+	g.AfterFunc(time.Second*2, func() {
+		close(ch1)
+	})
+	its := make([]*htimer, 100)
+	for i := range its {
+		its[i] = g.afterFunc(time.Second+time.Duration(i)*time.Millisecond, func() {
+			log.Panicf("stop failed")
+		})
+	}
+	if n := g.Stats().Timers; n != 101 {
+		log.Panicf("invalid timers length: %v", n)
+	}
+	for _, it := range its {
+		it.Stop()
+	}
+	if n := g.Stats().Timers; n != 1 {
+		log.Panicf("invalid timers length: %v", n)
+	}
+	<-ch1
+	if to1 := time.Since(t1); to1 < time.Second*2 || to1 > time.Second*3 {
+		log.Panicf("invalid to1: %v", to1)
+	}
+}
+
+func TestTicker(t *testing.T) {
+	for _, conf := range []Config{{}, {TimerWheel: true, TimerWheelTick: time.Millisecond * 5}} {
+		g := NewGopher(conf)
+		g.Start()
+
+		period := time.Second / 20
+
+		t1 := time.Now()
+		tk := g.NewTicker(period)
+		for i := 1; i <= 5; i++ {
+			<-tk.C
+		}
+		if to1 := time.Since(t1); to1 < period*5 || to1 > period*7 {
+			log.Panicf("invalid to1: %v", to1)
+		}
+		tk.Reset(period * 4)
+		t2 := time.Now()
+		<-tk.C
+		if to2 := time.Since(t2); to2 < period*4 || to2 > period*6 {
+			log.Panicf("invalid to2: %v", to2)
+		}
+		tk.Stop()
+		select {
+		case <-tk.C:
+			log.Panicf("stop failed")
+		case <-time.After(period * 5):
+		}
+
+		var running, calls int32
+		every := g.Every(period, func() {
+			if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+				log.Panicf("concurrent call")
+			}
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(period * 3 / 2)
+			atomic.StoreInt32(&running, 0)
+		})
+		time.Sleep(period * 10)
+		every.Stop()
+		time.Sleep(period * 2)
+		n := atomic.LoadInt32(&calls)
+		if n < 4 || n > 6 {
+			log.Panicf("invalid calls: %v", n)
+		}
+		time.Sleep(period * 3)
+		if atomic.LoadInt32(&calls) != n {
+			log.Panicf("stop failed")
+		}
+
+		g.Stop()
+	}
+}
+
 func TestStop(t *testing.T) {
 	gopher.Stop()
 	os.Remove(testfile)
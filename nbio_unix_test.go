@@ -0,0 +1,442 @@
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInheritSockets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:8895")
+	if err != nil {
+		log.Panicf("Listen failed: %v", err)
+	}
+	lnFd, err := net.Listen("tcp", "127.0.0.1:8896")
+	if err != nil {
+		log.Panicf("Listen failed: %v", err)
+	}
+	f, err := lnFd.(*net.TCPListener).File()
+	if err != nil {
+		log.Panicf("File failed: %v", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		log.Panicf("Dup failed: %v", err)
+	}
+	f.Close()
+	lnFd.Close()
+
+	g := NewGopher(Config{
+		Listeners:   []net.Listener{ln},
+		ListenerFds: []int{fd},
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		c.Write(append([]byte{}, data...))
+	})
+	err = g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	buf := make([]byte, 5)
+	for _, addr := range []string{"127.0.0.1:8895", "127.0.0.1:8896"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Panicf("Dial failed: %v", err)
+		}
+		conn.Write([]byte("hello"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			log.Panicf("echo failed: %v, %v", string(buf), err)
+		}
+		conn.Close()
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "http:https")
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	fds, err := systemdFds([]string{"https"})
+	if err != nil || len(fds) != 1 || fds[0] != systemdListenFdsStart+1 {
+		log.Panicf("invalid systemd fds: %v, %v", fds, err)
+	}
+	// the fds adopted are not returned again
+	fds, err = systemdFds(nil)
+	if err != nil || len(fds) != 1 || fds[0] != systemdListenFdsStart {
+		log.Panicf("invalid systemd fds: %v, %v", fds, err)
+	}
+	fds, err = systemdFds(nil)
+	if err != nil || len(fds) != 0 {
+		log.Panicf("invalid systemd fds: %v, %v", fds, err)
+	}
+	os.Setenv("LISTEN_PID", "1")
+	fds, err = systemdFds(nil)
+	if err != nil || len(fds) != 0 {
+		log.Panicf("invalid systemd fds: %v, %v", fds, err)
+	}
+}
+
+func TestZeroCopy(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	big := make([]byte, 1024*1024)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	small := []byte("hello")
+
+	chReleased := make(chan struct{}, 1)
+	g := NewGopher(Config{
+		Network:           "tcp",
+		Addrs:             []string{"127.0.0.1:8903"},
+		ZeroCopyThreshold: 64 * 1024,
+	})
+	g.OnOpen(func(c *Conn) {
+		if !c.zeroCopy {
+			log.Panicf("SO_ZEROCOPY not enabled")
+		}
+		c.Write(big)
+		c.Write(small)
+		if len(c.zcPending) != 1 {
+			log.Panicf("invalid zero-copy pending buffers: %v", len(c.zcPending))
+		}
+	})
+	g.OnWriteBufferRelease(func(c *Conn, b []byte) {
+		if len(b) > 0 && &b[0] == &big[0] {
+			chReleased <- struct{}{}
+		}
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8903")
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, len(big)+len(small))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		log.Panicf("ReadFull failed: %v", err)
+	}
+	for i := range big {
+		if buf[i] != big[i] {
+			log.Panicf("invalid data at %v", i)
+		}
+	}
+	if string(buf[len(big):]) != string(small) {
+		log.Panicf("invalid data: %v", string(buf[len(big):]))
+	}
+
+	select {
+	case <-chReleased:
+	case <-time.After(time.Second * 3):
+		log.Panicf("zero-copy buffer not released")
+	}
+}
+
+func TestSplice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	backend, err := net.Listen("tcp", "127.0.0.1:8905")
+	if err != nil {
+		log.Panicf("Listen failed: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	chClosed := make(chan error, 2)
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{"127.0.0.1:8904"},
+	})
+	g.OnOpen(func(c *Conn) {
+		if c.LocalAddr().String() != "127.0.0.1:8904" {
+			return
+		}
+		c.PauseRead()
+		g.DialAsync("tcp", "127.0.0.1:8905", time.Second, func(dst *Conn, err error) {
+			if err != nil {
+				c.CloseWithError(err)
+				return
+			}
+			if err := c.SpliceTo(dst); err != nil {
+				log.Panicf("SpliceTo failed: %v", err)
+			}
+			if err := dst.SpliceTo(c); err != nil {
+				log.Panicf("SpliceTo failed: %v", err)
+			}
+			c.ResumeRead()
+		})
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		log.Panicf("OnData called for spliced conn")
+	})
+	g.OnClose(func(c *Conn, err error) {
+		chClosed <- err
+	})
+	err = g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8904")
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 1024*1024*4)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	go func() {
+		conn.Write(data)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	echo, err := io.ReadAll(conn)
+	if err != nil {
+		log.Panicf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(echo, data) {
+		log.Panicf("invalid echo: %v, %v", len(echo), len(data))
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-chClosed:
+			if err != nil && err != io.EOF {
+				log.Panicf("invalid close error: %v", err)
+			}
+		case <-time.After(time.Second * 3):
+			log.Panicf("spliced conns not closed")
+		}
+	}
+}
+
+func TestHandoffFailed(t *testing.T) {
+	hoAddr := "127.0.0.1:8913"
+	hoPath := "nbio_handoff_failed_test.sock"
+	defer os.Remove(hoPath)
+
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{hoAddr},
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		c.Write([]byte("old"))
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", hoAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 3)
+	conn.Write([]byte("x"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "old" {
+		log.Panicf("read failed: %v, %v", string(buf), err)
+	}
+
+	// a new process which receives the fds and fails
+	go func() {
+		var uc net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			if uc, err = net.Dial("unix", hoPath); err == nil {
+				break
+			}
+			time.Sleep(time.Second / 100)
+		}
+		if err != nil {
+			return
+		}
+		defer uc.Close()
+		oob := make([]byte, syscall.CmsgSpace(handoffMaxFds*4))
+		_, oobn, _, _, err := uc.(*net.UnixConn).ReadMsgUnix(make([]byte, handoffMaxFds), oob)
+		if err != nil {
+			return
+		}
+		msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+		for i := range msgs {
+			fds, _ := syscall.ParseUnixRights(&msgs[i])
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+		}
+		uc.Write([]byte{'X'})
+	}()
+
+	err = g.ServeHandoff(hoPath, time.Second*5, func(c *Conn) bool { return true })
+	if err != errInvalidHandoff {
+		log.Panicf("ServeHandoff to a failed process: %v", err)
+	}
+
+	conn.Write([]byte("x"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "old" {
+		log.Panicf("read after failed handoff failed: %v, %v", string(buf), err)
+	}
+}
+
+func TestSendfileDropped(t *testing.T) {
+	sdAddr := "127.0.0.1:8915"
+	f, err := ioutil.TempFile("", "nbio_sendfile")
+	if err != nil {
+		log.Panicf("TempFile failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// larger than the socket buffers, the segment is left queued while the peer doesn't read
+	if err := f.Truncate(1024 * 1024 * 64); err != nil {
+		log.Panicf("Truncate failed: %v", err)
+	}
+
+	chDone := make(chan error, 1)
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{sdAddr},
+	})
+	g.OnOpen(func(c *Conn) {
+		err := c.SendfileRange(f, 0, 0, func(c *Conn, n int64, err error) {
+			// the Conn is usable in done
+			if _, werr := c.Write([]byte("x")); werr != errClosed {
+				log.Panicf("Write after closed: %v", werr)
+			}
+			c.Close()
+			chDone <- err
+		})
+		if err != nil {
+			log.Panicf("SendfileRange failed: %v", err)
+		}
+		time.AfterFunc(time.Second/10, func() { c.Close() })
+	})
+	err = g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", sdAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-chDone:
+		if err != errClosed {
+			log.Panicf("invalid done error: %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		log.Panicf("SendfileRange done not called")
+	}
+}
+
+func TestSplicePaused(t *testing.T) {
+	spAddr := "127.0.0.1:8917"
+	chConn := make(chan *Conn, 1)
+	chData := make(chan string, 4)
+	g := NewGopher(Config{
+		Network: "tcp",
+		Addrs:   []string{spAddr},
+	})
+	g.OnData(func(c *Conn, data []byte) {
+		if string(data) == "open" {
+			chConn <- c
+			return
+		}
+		chData <- string(data)
+	})
+	err := g.Start()
+	if err != nil {
+		log.Panicf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	conn, err := net.Dial("tcp", spAddr)
+	if err != nil {
+		log.Panicf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("open"))
+	c := <-chConn
+
+	expect := func(data string) {
+		select {
+		case s := <-chData:
+			if s != data {
+				log.Panicf("invalid data: %v", s)
+			}
+		case <-time.After(time.Second):
+			log.Panicf("data not read")
+		}
+	}
+	expectNone := func() {
+		select {
+		case s := <-chData:
+			log.Panicf("read while paused: %v", s)
+		case <-time.After(time.Second / 10):
+		}
+	}
+
+	// resuming by the application doesn't clear the pause of splice
+	c.setSplicePaused(true)
+	c.PauseRead()
+	c.ResumeRead()
+	conn.Write([]byte("a"))
+	expectNone()
+	c.setSplicePaused(false)
+	expect("a")
+
+	// resuming by splice doesn't clear the pause of the application
+	c.PauseRead()
+	c.setSplicePaused(true)
+	c.setSplicePaused(false)
+	conn.Write([]byte("b"))
+	expectNone()
+	if !c.IsReadPaused() {
+		log.Panicf("pause of the application cleared")
+	}
+	c.ResumeRead()
+	expect("b")
+}
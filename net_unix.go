@@ -7,11 +7,58 @@
 package nbio
 
 import (
+	"context"
 	"errors"
 	"net"
 	"syscall"
+	"unsafe"
 )
 
+// maxIovecs is IOV_MAX on linux and bsd.
+const maxIovecs = 1024
+
+func writev(fd int, iovs []syscall.Iovec) (int, error) {
+	r, _, e := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if e != 0 {
+		return -1, e
+	}
+	return int(r), nil
+}
+
+// setReusePort sets SO_REUSEPORT, which is 0x0F on most linux archs and 0x200 on bsd.
+func setReusePort(fd int) error {
+	socketOptReusePort := 0x0F
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, socketOptReusePort, 1); err != nil {
+		socketOptReusePort = 0x200
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, socketOptReusePort, 1)
+	}
+	return nil
+}
+
+func reusePortListenConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var err error
+			errCtrl := rc.Control(func(fd uintptr) {
+				err = setReusePort(int(fd))
+			})
+			if errCtrl != nil {
+				return errCtrl
+			}
+			return err
+		},
+	}
+}
+
+// listenStream creates a stream listener, with SO_REUSEPORT if reusePort is true,
+// so that multiple listeners can be bound to the same addr and the kernel balances connections between them.
+func listenStream(network, addr string, reusePort bool) (net.Listener, error) {
+	if reusePort && !isUnixNetwork(network) {
+		return reusePortListenConfig().Listen(context.Background(), network, addr)
+	}
+	return net.Listen(network, addr)
+}
+
 func sockaddrToAddr(sa syscall.Sockaddr) net.Addr {
 	var a net.Addr
 	switch sa := sa.(type) {
@@ -38,7 +85,53 @@ func sockaddrToAddr(sa syscall.Sockaddr) net.Addr {
 	return a
 }
 
+func sockaddrToUDPAddr(sa syscall.Sockaddr) *net.UDPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{
+			IP:   append([]byte{}, sa.Addr[:]...),
+			Port: sa.Port,
+		}
+	case *syscall.SockaddrInet6:
+		var zone string
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				zone = ifi.Name
+			}
+		}
+		return &net.UDPAddr{
+			IP:   append([]byte{}, sa.Addr[:]...),
+			Port: sa.Port,
+			Zone: zone,
+		}
+	}
+	return nil
+}
+
+// sockaddrKey returns a compact map key for a udp remote addr.
+func sockaddrKey(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		var b [6]byte
+		copy(b[:], sa.Addr[:])
+		b[4], b[5] = byte(sa.Port>>8), byte(sa.Port)
+		return string(b[:])
+	case *syscall.SockaddrInet6:
+		var b [22]byte
+		copy(b[:], sa.Addr[:])
+		b[16], b[17] = byte(sa.Port>>8), byte(sa.Port)
+		b[18], b[19], b[20], b[21] = byte(sa.ZoneId>>24), byte(sa.ZoneId>>16), byte(sa.ZoneId>>8), byte(sa.ZoneId)
+		return string(b[:])
+	}
+	return ""
+}
+
 func getSockaddr(proto, addr string) (sa syscall.Sockaddr, soType int, err error) {
+	if isUnixNetwork(proto) {
+		// a name with prefix "@" represents an abstract socket on linux
+		return &syscall.SockaddrUnix{Name: addr}, syscall.AF_UNIX, nil
+	}
+
 	var tcp *net.TCPAddr
 
 	tcp, err = net.ResolveTCPAddr(proto, addr)
@@ -112,21 +205,24 @@ func listen(network, address string, backlogNum int64) (int, error) {
 		return -1, err
 	}
 
+	proto := syscall.IPPROTO_TCP
+	if soType == syscall.AF_UNIX {
+		proto = 0
+	}
+
 	syscall.ForkLock.RLock()
 	defer syscall.ForkLock.RUnlock()
-	if fd, err = syscall.Socket(soType, syscall.SOCK_STREAM, syscall.IPPROTO_TCP); err != nil {
+	if fd, err = syscall.Socket(soType, syscall.SOCK_STREAM, proto); err != nil {
 		return -1, err
 	}
 
-	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		syscall.Close(fd)
-		return -1, err
-	}
+	if soType != syscall.AF_UNIX {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			syscall.Close(fd)
+			return -1, err
+		}
 
-	socketOptReusePort := 0x0F
-	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, socketOptReusePort, 1); err != nil {
-		socketOptReusePort = 0x200
-		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, socketOptReusePort, 1); err != nil {
+		if err = setReusePort(fd); err != nil {
 			syscall.Close(fd)
 			return -1, err
 		}
@@ -187,9 +283,23 @@ func dupStdConn(conn net.Conn) (*Conn, error) {
 		return nil, err
 	}
 
-	return &Conn{
+	c := &Conn{
 		fd:    newFd,
 		lAddr: conn.LocalAddr(),
 		rAddr: conn.RemoteAddr(),
-	}, nil
+	}
+	switch conn.(type) {
+	case *net.UDPConn:
+		c.typ = connTypeUDPClientFromDial
+	case *net.UnixConn:
+		c.typ = connTypeUnix
+		if c.lAddr == nil {
+			c.lAddr = &net.UnixAddr{Net: "unix"}
+		}
+		if c.rAddr == nil {
+			c.rAddr = &net.UnixAddr{Net: "unix"}
+		}
+	}
+
+	return c, nil
 }
@@ -10,6 +10,8 @@ import (
 	"io"
 	"net"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -25,6 +27,14 @@ const (
 )
 
 type poller struct {
+	online int64
+
+	// bytesRead and bytesWritten of the poller's conns are summed by Gopher.Stats.
+	bytesRead    uint64
+	bytesWritten uint64
+	// loopTime is the time the poller woke up for the events being handled, 0 while it's waiting.
+	loopTime int64
+
 	g *Gopher
 
 	epfd  int
@@ -40,20 +50,49 @@ type poller struct {
 	ReadBuffer []byte
 
 	pollType string
+
+	mux     sync.Mutex
+	tasks   []func()
+	stopped bool
 }
 
 func (p *poller) addConn(c *Conn) {
 	c.g = p.g
-	p.g.onOpen(c)
+	c.initRateLimit()
+	if p.g.zeroCopyThreshold > 0 {
+		c.enableZeroCopy()
+	}
+	if c.typ != connTypeUDPServer {
+		c.statsOpen()
+		if c.proxy == nil {
+			p.g.onOpen(c)
+		}
+	}
 	fd := c.fd
 	p.g.connsUnix[fd] = c
-	err := p.addRead(fd)
+	// OnOpen may have paused reading or cached data to write before the fd is added
+	c.mux.Lock()
+	var events uint32 = epoollEventsRead
+	if c.readPaused {
+		events = 0
+	}
+	if c.isWAdded {
+		events |= epoollEventsWrite
+	}
+	c.mux.Unlock()
+	err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: events})
 	if err != nil {
 		p.g.connsUnix[fd] = nil
 		c.closeWithError(err)
 		logging.Error("[%v] add read event failed: %v", c.fd, err)
 		return
 	}
+	if c.typ != connTypeUDPServer {
+		atomic.AddInt64(&p.online, 1)
+	}
+	if c.proxy != nil {
+		c.waitProxyHeader(p.g.proxyProtocolTimeout)
+	}
 }
 
 func (p *poller) getConn(fd int) *Conn {
@@ -68,8 +107,21 @@ func (p *poller) deleteConn(c *Conn) {
 	if c == p.g.connsUnix[fd] {
 		p.g.connsUnix[fd] = nil
 		p.deleteEvent(fd)
+		if c.typ != connTypeUDPServer {
+			atomic.AddInt64(&p.online, -1)
+		}
+	}
+	p.g.releaseAdmission(c.admitKey)
+	if c.typ != connTypeUDPServer {
+		p.g.statsClose(c.closeErr)
+		// OnOpen has not been called for a conn waiting for the PROXY protocol header
+		if c.proxy == nil {
+			p.g.onClose(c, c.closeErr)
+		}
+	}
+	if c.reconn != nil {
+		c.reconn.onClose(c, c.closeErr)
 	}
-	p.g.onClose(c, c.closeErr)
 }
 
 func (p *poller) start() {
@@ -78,6 +130,10 @@ func (p *poller) start() {
 	logging.Debug("Poller[%v_%v_%v] start", p.g.Name, p.pollType, p.index)
 	defer logging.Debug("Poller[%v_%v_%v] stopped", p.g.Name, p.pollType, p.index)
 	defer func() {
+		p.mux.Lock()
+		p.stopped = true
+		p.tasks = nil
+		p.mux.Unlock()
 		syscall.Close(p.epfd)
 		syscall.Close(p.evtfd)
 	}()
@@ -99,11 +155,21 @@ func (p *poller) acceptorLoop() {
 	for !p.shutdown {
 		conn, err := p.listener.Accept()
 		if err == nil {
+			key, ok := p.g.admit(conn)
+			if !ok {
+				continue
+			}
 			c, err := NBConn(conn)
 			if err != nil {
+				p.g.releaseAdmission(key)
 				conn.Close()
 				continue
 			}
+			c.admitKey = key
+			if p.g.proxyProtocol {
+				c.proxy = &proxyReader{}
+			}
+			p.g.statsAccept()
 			o := p.g.pollers[int(c.fd)%len(p.g.pollers)]
 			o.addConn(c)
 		} else {
@@ -131,10 +197,12 @@ func (p *poller) readWriteLoop() {
 	p.shutdown = false
 
 	for !p.shutdown {
+		atomic.StoreInt64(&p.loopTime, 0)
 		n, err := syscall.EpollWait(p.epfd, events, msec)
 		if err != nil && err != syscall.EINTR {
 			return
 		}
+		atomic.StoreInt64(&p.loopTime, time.Now().UnixNano())
 
 		if n <= 0 {
 			msec = -1
@@ -147,6 +215,7 @@ func (p *poller) readWriteLoop() {
 			fd = int(events[i].Fd)
 			switch fd {
 			case p.evtfd:
+				p.runTasks()
 			default:
 				p.readWrite(&events[i])
 			}
@@ -165,18 +234,88 @@ func (p *poller) stop() {
 	}
 }
 
+// now returns the time of the events being handled, or the current time while the poller is waiting,
+// so that the conns' last read and write times don't call time.Now for each operation.
+func (p *poller) now() int64 {
+	if t := atomic.LoadInt64(&p.loopTime); t > 0 {
+		return t
+	}
+	return time.Now().UnixNano()
+}
+
+// exec runs f on the poller's goroutine, f is dropped if the poller has stopped.
+func (p *poller) exec(f func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.stopped {
+		return
+	}
+	p.tasks = append(p.tasks, f)
+	n := uint64(1)
+	syscall.Write(p.evtfd, (*(*[8]byte)(unsafe.Pointer(&n)))[:])
+}
+
+func (p *poller) runTasks() {
+	var b [8]byte
+	syscall.Read(p.evtfd, b[:])
+	p.mux.Lock()
+	tasks := p.tasks
+	p.tasks = nil
+	p.mux.Unlock()
+	for _, f := range tasks {
+		f()
+	}
+}
+
+// closeFds closes the fds of a poller which has not been started.
+func (p *poller) closeFds() {
+	syscall.Close(p.epfd)
+	syscall.Close(p.evtfd)
+}
+
 func (p *poller) addRead(fd int) error {
 	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: epoollEventsRead})
 }
 
-// func (p *poller) addWrite(fd int) error {
-// 	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: syscall.EPOLLOUT})
-// }
+func (p *poller) addWrite(fd int) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: syscall.EPOLLOUT})
+}
+
+func (p *poller) modRead(fd int) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: epoollEventsRead})
+}
 
 func (p *poller) modWrite(fd int) error {
 	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: epoollEventsReadWrite})
 }
 
+// pauseRead removes read events, keeps write events if writing.
+func (p *poller) pauseRead(fd int, writing bool) error {
+	var events uint32
+	if writing {
+		events = epoollEventsWrite
+	}
+	return p.modEvents(fd, events)
+}
+
+// resumeRead adds read events back, keeps write events if writing.
+func (p *poller) resumeRead(fd int, writing bool) error {
+	var events uint32 = epoollEventsRead
+	if writing {
+		events = epoollEventsReadWrite
+	}
+	return p.modEvents(fd, events)
+}
+
+func (p *poller) modEvents(fd int, events uint32) error {
+	err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: events})
+	if err == syscall.ENOENT {
+		// called in OnOpen before the fd is added, addConn applies the state then
+		return nil
+	}
+	return err
+}
+
 func (p *poller) deleteEvent(fd int) error {
 	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{Fd: int32(fd)})
 }
@@ -185,20 +324,68 @@ func (p *poller) readWrite(ev *syscall.EpollEvent) {
 	fd := int(ev.Fd)
 	c := p.getConn(fd)
 	if c != nil {
+		if c.dialer != nil {
+			c.finishDial(p)
+			return
+		}
+
+		if c.typ == connTypeUDPServer {
+			if ev.Events&epoollEventsRead != 0 {
+				p.readUDP(c)
+			}
+			return
+		}
+
+		if ev.Events&syscall.EPOLLERR != 0 && c.zeroCopy {
+			// EPOLLERR is also reported for the completions of zero-copy sends in the error queue
+			if err := c.reapZeroCopy(); err != nil {
+				c.closeWithError(err)
+				return
+			}
+			ev.Events &^= syscall.EPOLLERR
+		}
+
 		if ev.Events&epoollEventsError != 0 {
+			if ev.Events&syscall.EPOLLERR == 0 && c.spliceTo != nil && c.spliceTo.hangup() {
+				return
+			}
+			if ev.Events&syscall.EPOLLERR == 0 && ev.Events&epoollEventsRead != 0 && c.proxy == nil {
+				// the peer's data may arrive with its FIN after CloseWrite, read it before closing
+				p.readHangup(c)
+				return
+			}
 			c.closeWithError(io.EOF)
 			return
 		}
 
 		if ev.Events&epoollEventsWrite != 0 {
 			c.flush()
+			if c.spliceFrom != nil {
+				c.spliceFrom.transfer()
+			}
 		}
 
 		if ev.Events&epoollEventsRead != 0 {
+			if c.proxy != nil {
+				c.readProxyHeader()
+				return
+			}
 			for i := 0; i < 3; i++ {
+				if c.spliceTo != nil {
+					// SpliceTo may be called in OnData
+					c.spliceTo.transfer()
+					return
+				}
 				buffer := p.g.borrow(c)
-				n, err := c.Read(buffer)
+				rbuf := c.limitRead(buffer)
+				if rbuf == nil {
+					// throttled by the rate limits
+					p.g.payback(c, buffer)
+					return
+				}
+				n, err := c.Read(rbuf)
 				if n > 0 {
+					c.readConsumed(n)
 					p.g.onData(c, buffer[:n])
 				}
 				p.g.payback(c, buffer)
@@ -208,7 +395,13 @@ func (p *poller) readWrite(ev *syscall.EpollEvent) {
 				if err == syscall.EAGAIN {
 					return
 				}
-				if err != nil || n == 0 {
+				if err == nil && n == 0 && (c.typ == connTypeTCP || c.typ == connTypeUnix) {
+					c.readEOF()
+				} else if err != nil || (n == 0 && c.typ != connTypeUDPClientFromDial) {
+					if err == nil {
+						// closed by the peer
+						err = io.EOF
+					}
 					c.closeWithError(err)
 				}
 				return
@@ -220,29 +413,41 @@ func (p *poller) readWrite(ev *syscall.EpollEvent) {
 	}
 }
 
-func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
-	if isListener {
-		if len(g.addrs) == 0 {
-			panic("invalid listener num")
+// readHangup reads the data left in a hung up Conn until EOF, then closes it.
+func (p *poller) readHangup(c *Conn) {
+	for {
+		buffer := p.g.borrow(c)
+		n, err := c.Read(buffer)
+		if n > 0 {
+			c.readConsumed(n)
+			p.g.onData(c, buffer[:n])
 		}
-
-		addr := g.addrs[index%len(g.listeners)]
-		ln, err := net.Listen(g.network, addr)
-		if err != nil {
-			return nil, err
+		p.g.payback(c, buffer)
+		if err == syscall.EINTR {
+			continue
 		}
-
-		p := &poller{
-			g:          g,
-			index:      index,
-			listener:   ln,
-			isListener: isListener,
-			pollType:   "LISTENER",
+		if err == nil && n > 0 {
+			continue
+		}
+		if err == nil || err == syscall.EAGAIN {
+			err = io.EOF
 		}
+		c.closeWithError(err)
+		return
+	}
+}
 
-		return p, nil
+func newListenerPoller(g *Gopher, ln net.Listener, index int) *poller {
+	return &poller{
+		g:          g,
+		index:      index,
+		listener:   ln,
+		isListener: true,
+		pollType:   "LISTENER",
 	}
+}
 
+func newPoller(g *Gopher, index int) (*poller, error) {
 	fd, err := syscall.EpollCreate1(0)
 	if err != nil {
 		return nil, err
@@ -270,7 +475,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 		epfd:       fd,
 		evtfd:      int(r0),
 		index:      index,
-		isListener: isListener,
+		isListener: false,
 		pollType:   "POLLER",
 	}
 
@@ -7,9 +7,11 @@
 package nbio
 
 import (
+	"io"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,6 +19,14 @@ import (
 )
 
 type poller struct {
+	online int64
+
+	// bytesRead and bytesWritten of the poller's conns are summed by Gopher.Stats.
+	bytesRead    uint64
+	bytesWritten uint64
+	// loopTime is the time the poller woke up for the events being handled, 0 while it's waiting.
+	loopTime int64
+
 	mux sync.Mutex
 
 	g *Gopher
@@ -37,14 +47,31 @@ type poller struct {
 	pollType string
 
 	eventList []syscall.Kevent_t
+	tasks     []func()
+	stopped   bool
 }
 
 func (p *poller) addConn(c *Conn) {
 	c.g = p.g
-	p.g.onOpen(c)
+	c.initRateLimit()
+	if c.typ != connTypeUDPServer {
+		c.statsOpen()
+		if c.proxy == nil {
+			p.g.onOpen(c)
+		}
+	}
 	fd := c.fd
 	p.g.connsUnix[fd] = c
 	p.addRead(c.fd)
+	if c.readPaused {
+		p.pauseRead(c.fd, false)
+	}
+	if c.typ != connTypeUDPServer {
+		atomic.AddInt64(&p.online, 1)
+	}
+	if c.proxy != nil {
+		c.waitProxyHeader(p.g.proxyProtocolTimeout)
+	}
 }
 
 func (p *poller) getConn(fd int) *Conn {
@@ -59,8 +86,21 @@ func (p *poller) deleteConn(c *Conn) {
 	if c == p.g.connsUnix[fd] {
 		p.g.connsUnix[fd] = nil
 		p.deleteEvent(fd)
+		if c.typ != connTypeUDPServer {
+			atomic.AddInt64(&p.online, -1)
+		}
+	}
+	p.g.releaseAdmission(c.admitKey)
+	if c.typ != connTypeUDPServer {
+		p.g.statsClose(c.closeErr)
+		// OnOpen has not been called for a conn waiting for the PROXY protocol header
+		if c.proxy == nil {
+			p.g.onClose(c, c.closeErr)
+		}
+	}
+	if c.reconn != nil {
+		c.reconn.onClose(c, c.closeErr)
 	}
-	p.g.onClose(c, c.closeErr)
 }
 
 func (p *poller) trigger() {
@@ -74,6 +114,25 @@ func (p *poller) addRead(fd int) {
 	p.trigger()
 }
 
+func (p *poller) addWrite(fd int) error {
+	p.mux.Lock()
+	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE})
+	p.mux.Unlock()
+	p.trigger()
+	return nil
+}
+
+func (p *poller) modRead(fd int) error {
+	p.mux.Lock()
+	p.eventList = append(p.eventList,
+		syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE},
+		syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_READ},
+	)
+	p.mux.Unlock()
+	p.trigger()
+	return nil
+}
+
 func (p *poller) modWrite(fd int) {
 	p.mux.Lock()
 	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE})
@@ -81,6 +140,27 @@ func (p *poller) modWrite(fd int) {
 	p.trigger()
 }
 
+// pauseRead disables read filter, adds write filter if writing.
+func (p *poller) pauseRead(fd int, writing bool) error {
+	p.mux.Lock()
+	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_DISABLE, Filter: syscall.EVFILT_READ})
+	if writing {
+		p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE})
+	}
+	p.mux.Unlock()
+	p.trigger()
+	return nil
+}
+
+// resumeRead enables read filter, the write filter is not changed.
+func (p *poller) resumeRead(fd int, writing bool) error {
+	p.mux.Lock()
+	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD | syscall.EV_ENABLE, Filter: syscall.EVFILT_READ})
+	p.mux.Unlock()
+	p.trigger()
+	return nil
+}
+
 func (p *poller) deleteEvent(fd int) {
 	p.mux.Lock()
 	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_READ})
@@ -95,11 +175,34 @@ func (p *poller) readWrite(ev *syscall.Kevent_t) {
 	fd := int(ev.Ident)
 	c := p.getConn(fd)
 	if c != nil {
+		if c.dialer != nil {
+			c.finishDial(p)
+			return
+		}
+
+		if c.typ == connTypeUDPServer {
+			if ev.Filter&syscall.EVFILT_READ != 0 {
+				p.readUDP(c)
+			}
+			return
+		}
+
 		if ev.Filter&syscall.EVFILT_READ != 0 {
+			if c.proxy != nil {
+				c.readProxyHeader()
+				return
+			}
 			for i := 0; i < 3; i++ {
 				buffer := p.g.borrow(c)
-				n, err := c.Read(buffer)
+				rbuf := c.limitRead(buffer)
+				if rbuf == nil {
+					// throttled by the rate limits
+					p.g.payback(c, buffer)
+					return
+				}
+				n, err := c.Read(rbuf)
 				if n > 0 {
+					c.readConsumed(n)
 					p.g.onData(c, buffer[:n])
 				}
 				p.g.payback(c, buffer)
@@ -109,7 +212,16 @@ func (p *poller) readWrite(ev *syscall.Kevent_t) {
 				if err == syscall.EAGAIN {
 					return
 				}
-				if (err != nil || n == 0) && ev.Flags&syscall.EV_DELETE == 0 {
+				if ev.Flags&syscall.EV_DELETE != 0 {
+					return
+				}
+				if err == nil && n == 0 && (c.typ == connTypeTCP || c.typ == connTypeUnix) {
+					c.readEOF()
+				} else if err != nil || (n == 0 && c.typ != connTypeUDPClientFromDial) {
+					if err == nil {
+						// closed by the peer
+						err = io.EOF
+					}
 					c.closeWithError(err)
 				}
 				return
@@ -134,7 +246,13 @@ func (p *poller) start() {
 
 	logging.Debug("Poller[%v_%v_%v] start", p.g.Name, p.pollType, p.index)
 	defer logging.Debug("Poller[%v_%v_%v] stopped", p.g.Name, p.pollType, p.index)
-	defer syscall.Close(p.kfd)
+	defer func() {
+		p.mux.Lock()
+		p.stopped = true
+		p.tasks = nil
+		p.mux.Unlock()
+		syscall.Close(p.kfd)
+	}()
 
 	if p.isListener {
 		p.acceptorLoop()
@@ -153,11 +271,21 @@ func (p *poller) acceptorLoop() {
 	for !p.shutdown {
 		conn, err := p.listener.Accept()
 		if err == nil {
+			key, ok := p.g.admit(conn)
+			if !ok {
+				continue
+			}
 			c, err := NBConn(conn)
 			if err != nil {
+				p.g.releaseAdmission(key)
 				conn.Close()
 				continue
 			}
+			c.admitKey = key
+			if p.g.proxyProtocol {
+				c.proxy = &proxyReader{}
+			}
+			p.g.statsAccept()
 			o := p.g.pollers[int(c.fd)%len(p.g.pollers)]
 			o.addConn(c)
 		} else {
@@ -187,14 +315,17 @@ func (p *poller) readWriteLoop() {
 		changes = p.eventList
 		p.eventList = nil
 		p.mux.Unlock()
+		atomic.StoreInt64(&p.loopTime, 0)
 		n, err := syscall.Kevent(p.kfd, changes, events, nil)
 		if err != nil && err != syscall.EINTR {
 			return
 		}
+		atomic.StoreInt64(&p.loopTime, time.Now().UnixNano())
 
 		for i := 0; i < n; i++ {
 			switch int(events[i].Ident) {
 			case p.evtfd:
+				p.runTasks()
 			default:
 				p.readWrite(&events[i])
 			}
@@ -211,28 +342,52 @@ func (p *poller) stop() {
 	p.trigger()
 }
 
-func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
-	if isListener {
-		if len(g.addrs) == 0 {
-			panic("invalid listener num")
-		}
+// now returns the time of the events being handled, or the current time while the poller is waiting,
+// so that the conns' last read and write times don't call time.Now for each operation.
+func (p *poller) now() int64 {
+	if t := atomic.LoadInt64(&p.loopTime); t > 0 {
+		return t
+	}
+	return time.Now().UnixNano()
+}
 
-		addr := g.addrs[index%len(g.listeners)]
-		ln, err := net.Listen(g.network, addr)
-		if err != nil {
-			return nil, err
-		}
+// exec runs f on the poller's goroutine, f is dropped if the poller has stopped.
+func (p *poller) exec(f func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.stopped {
+		return
+	}
+	p.tasks = append(p.tasks, f)
+	p.trigger()
+}
 
-		p := &poller{
-			g:          g,
-			index:      index,
-			listener:   ln,
-			isListener: isListener,
-			pollType:   "LISTENER",
-		}
-		return p, nil
+func (p *poller) runTasks() {
+	p.mux.Lock()
+	tasks := p.tasks
+	p.tasks = nil
+	p.mux.Unlock()
+	for _, f := range tasks {
+		f()
 	}
+}
+
+// closeFds closes the fds of a poller which has not been started.
+func (p *poller) closeFds() {
+	syscall.Close(p.kfd)
+}
+
+func newListenerPoller(g *Gopher, ln net.Listener, index int) *poller {
+	return &poller{
+		g:          g,
+		index:      index,
+		listener:   ln,
+		isListener: true,
+		pollType:   "LISTENER",
+	}
+}
 
+func newPoller(g *Gopher, index int) (*poller, error) {
 	fd, err := syscall.Kqueue()
 	if err != nil {
 		return nil, err
@@ -253,7 +408,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 		g:          g,
 		kfd:        fd,
 		index:      index,
-		isListener: isListener,
+		isListener: false,
 		pollType:   "POLLER",
 	}
 
@@ -7,15 +7,23 @@
 package nbio
 
 import (
+	"io"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lesismal/nbio/logging"
 )
 
 type poller struct {
+	online int64
+
+	// bytesRead and bytesWritten of the poller's conns are summed by Gopher.Stats.
+	bytesRead    uint64
+	bytesWritten uint64
+
 	mux sync.Mutex
 
 	g *Gopher
@@ -32,13 +40,27 @@ type poller struct {
 	chStop chan struct{}
 }
 
+// now returns the current time, the conns of a std poller are read by their own goroutines.
+func (p *poller) now() int64 {
+	return time.Now().UnixNano()
+}
+
 func (p *poller) accept() error {
 	conn, err := p.listener.Accept()
 	if err != nil {
 		return err
 	}
 
+	key, ok := p.g.admit(conn)
+	if !ok {
+		return nil
+	}
+	p.g.statsAccept()
 	c := newConn(conn)
+	c.admitKey = key
+	if p.g.proxyProtocol {
+		c.proxy = &proxyReader{}
+	}
 	o := p.g.pollers[c.Hash()%len(p.g.pollers)]
 	o.addConn(c)
 
@@ -47,14 +69,25 @@ func (p *poller) accept() error {
 
 func (p *poller) readConn(c *Conn) {
 	for {
+		c.waitResume()
 		buffer := p.g.borrow(c)
-		n, err := c.Read(buffer)
+		n, err := c.Read(c.limitRead(buffer))
 		if n > 0 {
+			c.readConsumed(n)
 			p.g.onData(c, buffer[:n])
 		}
 		p.g.payback(c, buffer)
+		if isTimeout(err) {
+			// the handler may close the Conn, then the next Read fails
+			c.conn.SetReadDeadline(time.Time{})
+			p.g.onReadTimeout(c)
+			continue
+		}
+		if err == io.EOF && c.readEOF() {
+			return
+		}
 		if err != nil {
-			c.Close()
+			c.CloseWithError(err)
 			return
 		}
 	}
@@ -62,9 +95,16 @@ func (p *poller) readConn(c *Conn) {
 
 func (p *poller) addConn(c *Conn) error {
 	c.g = p.g
+	c.initRateLimit()
 	p.g.mux.Lock()
 	p.g.connsStd[c] = struct{}{}
 	p.g.mux.Unlock()
+	atomic.AddInt64(&p.online, 1)
+	c.statsOpen()
+	if c.proxy != nil {
+		go p.readProxyHeader(c)
+		return nil
+	}
 	p.g.onOpen(c)
 	go p.readConn(c)
 
@@ -75,7 +115,19 @@ func (p *poller) deleteConn(c *Conn) {
 	p.g.mux.Lock()
 	delete(p.g.connsStd, c)
 	p.g.mux.Unlock()
-	p.g.onClose(c, c.closeErr)
+	atomic.AddInt64(&p.online, -1)
+	p.g.releaseAdmission(c.admitKey)
+	p.g.statsClose(c.closeErr)
+	// OnOpen has not been called for a conn waiting for the PROXY protocol header
+	c.mux.Lock()
+	opened := c.proxy == nil
+	c.mux.Unlock()
+	if opened {
+		p.g.onClose(c, c.closeErr)
+	}
+	if c.reconn != nil {
+		c.reconn.onClose(c, c.closeErr)
+	}
 }
 
 func (p *poller) start() {
@@ -117,24 +169,23 @@ func (p *poller) stop() {
 	close(p.chStop)
 }
 
-func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
-	p := &poller{
+func newListenerPoller(g *Gopher, ln net.Listener, index int) *poller {
+	return &poller{
 		g:          g,
 		index:      index,
-		isListener: isListener,
+		listener:   ln,
+		isListener: true,
+		pollType:   "LISTENER",
 		chStop:     make(chan struct{}),
 	}
+}
 
-	if isListener {
-		var err error
-		var addr = g.addrs[index%len(g.addrs)]
-		p.listener, err = net.Listen(g.network, addr)
-		if err != nil {
-			return nil, err
-		}
-		p.pollType = "LISTENER"
-	} else {
-		p.pollType = "POLLER"
+func newPoller(g *Gopher, index int) (*poller, error) {
+	p := &poller{
+		g:        g,
+		index:    index,
+		chStop:   make(chan struct{}),
+		pollType: "POLLER",
 	}
 
 	return p, nil
@@ -0,0 +1,358 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 TLV types.
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+)
+
+const (
+	proxyV1MaxSize  = 107
+	proxyV2HeadSize = 16
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2AFUnspec = 0x0
+	proxyV2AFInet   = 0x1
+	proxyV2AFInet6  = 0x2
+	proxyV2AFUnix   = 0x3
+
+	proxyV2Stream = 0x1
+	proxyV2Dgram  = 0x2
+
+	proxyV2Inet4Size = 12
+	proxyV2Inet6Size = 36
+	proxyV2UnixSize  = 216
+)
+
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var (
+	// ErrProxyHeader is used to close a conn accepted without a valid PROXY protocol header.
+	ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+	// ErrProxyHeaderTimeout is used to close a conn accepted whose PROXY protocol header is not complete in ProxyProtocolTimeout.
+	ErrProxyHeaderTimeout = errors.New("proxy protocol header timeout")
+)
+
+// ProxyTLV is a type-length-value of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader represents a PROXY protocol header.
+type ProxyHeader struct {
+	// Version is 1 for the text format or 2 for the binary format.
+	Version int
+
+	// Local is true if the header doesn't carry the addrs of the client: for the v2 LOCAL command,
+	// or the UNKNOWN/UNSPEC protocol, the addrs of a Conn are not rewritten then.
+	Local bool
+
+	// SourceAddr is the addr of the client, a *net.TCPAddr, *net.UDPAddr or *net.UnixAddr.
+	SourceAddr net.Addr
+
+	// DestinationAddr is the addr the client connected to.
+	DestinationAddr net.Addr
+
+	// TLVs are the TLVs of a v2 header, in the order they were sent.
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of typ.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Encode returns the header in the format of Version, v1 supports tcp addrs only and no TLVs.
+func (h *ProxyHeader) Encode() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.encodeV1()
+	case 2:
+		return h.encodeV2()
+	}
+	return nil, errors.New("invalid proxy protocol version: " + strconv.Itoa(h.Version))
+}
+
+func (h *ProxyHeader) encodeV1() ([]byte, error) {
+	if len(h.TLVs) > 0 {
+		return nil, errors.New("tlvs not supported by proxy protocol v1")
+	}
+	if h.Local || h.SourceAddr == nil || h.DestinationAddr == nil {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	src, ok1 := h.SourceAddr.(*net.TCPAddr)
+	dst, ok2 := h.DestinationAddr.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, errors.New("only tcp addrs supported by proxy protocol v1")
+	}
+	proto, srcIP, dstIP := "TCP4", src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		proto, srcIP, dstIP = "TCP6", src.IP.To16(), dst.IP.To16()
+	}
+	if srcIP == nil || dstIP == nil {
+		return nil, ErrProxyHeader
+	}
+	line := "PROXY " + proto + " " + srcIP.String() + " " + dstIP.String() + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n"
+	return []byte(line), nil
+}
+
+func (h *ProxyHeader) encodeV2() ([]byte, error) {
+	var cmd, fam byte = proxyV2CmdProxy, 0
+	var addrs []byte
+	if h.Local || h.SourceAddr == nil || h.DestinationAddr == nil {
+		cmd = proxyV2CmdLocal
+	} else {
+		switch src := h.SourceAddr.(type) {
+		case *net.TCPAddr, *net.UDPAddr:
+			srcIP, srcPort, proto := ipPort(src)
+			dstIP, dstPort, dstProto := ipPort(h.DestinationAddr)
+			if dstIP == nil || dstProto != proto {
+				return nil, ErrProxyHeader
+			}
+			af := byte(proxyV2AFInet)
+			if srcIP.To4() == nil || dstIP.To4() == nil {
+				af = proxyV2AFInet6
+				srcIP, dstIP = srcIP.To16(), dstIP.To16()
+			} else {
+				srcIP, dstIP = srcIP.To4(), dstIP.To4()
+			}
+			fam = af<<4 | proto
+			addrs = append(addrs, srcIP...)
+			addrs = append(addrs, dstIP...)
+			addrs = append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+		case *net.UnixAddr:
+			dst, ok := h.DestinationAddr.(*net.UnixAddr)
+			if !ok || len(src.Name) > proxyV2UnixSize/2 || len(dst.Name) > proxyV2UnixSize/2 {
+				return nil, ErrProxyHeader
+			}
+			fam = proxyV2AFUnix<<4 | proxyV2Stream
+			if src.Net == "unixgram" {
+				fam = proxyV2AFUnix<<4 | proxyV2Dgram
+			}
+			addrs = make([]byte, proxyV2UnixSize)
+			copy(addrs, src.Name)
+			copy(addrs[proxyV2UnixSize/2:], dst.Name)
+		default:
+			return nil, ErrProxyHeader
+		}
+	}
+
+	size := len(addrs)
+	for _, tlv := range h.TLVs {
+		size += 3 + len(tlv.Value)
+	}
+	if size > 0xFFFF {
+		return nil, ErrProxyHeader
+	}
+	b := make([]byte, proxyV2HeadSize, proxyV2HeadSize+size)
+	copy(b, proxyV2Sig)
+	b[12] = 0x20 | cmd
+	b[13] = fam
+	binary.BigEndian.PutUint16(b[14:], uint16(size))
+	b = append(b, addrs...)
+	for _, tlv := range h.TLVs {
+		b = append(b, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	return b, nil
+}
+
+func ipPort(addr net.Addr) (net.IP, int, byte) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, proxyV2Stream
+	case *net.UDPAddr:
+		return a.IP, a.Port, proxyV2Dgram
+	}
+	return nil, 0, 0
+}
+
+// parseProxyHeader parses the PROXY protocol header at the beginning of b and returns it with its size,
+// or nil without error if b is not enough to decide.
+func parseProxyHeader(b []byte) (*ProxyHeader, int, error) {
+	switch {
+	case bytes.HasPrefix(b, proxyV2Sig):
+		return parseProxyHeaderV2(b)
+	case bytes.HasPrefix(b, proxyV1Sig):
+		return parseProxyHeaderV1(b)
+	case bytes.HasPrefix(proxyV2Sig, b), bytes.HasPrefix(proxyV1Sig, b):
+		return nil, 0, nil
+	}
+	return nil, 0, ErrProxyHeader
+}
+
+func parseProxyHeaderV1(b []byte) (*ProxyHeader, int, error) {
+	if len(b) > proxyV1MaxSize {
+		b = b[:proxyV1MaxSize]
+	}
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		if len(b) == proxyV1MaxSize {
+			return nil, 0, ErrProxyHeader
+		}
+		return nil, 0, nil
+	}
+
+	h := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(b[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, ErrProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil || (srcIP.To4() != nil) != (fields[1] == "TCP4") || (dstIP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, 0, ErrProxyHeader
+	}
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if err1 != nil || err2 != nil {
+		return nil, 0, ErrProxyHeader
+	}
+	h.SourceAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, end + 2, nil
+}
+
+func parseProxyHeaderV2(b []byte) (*ProxyHeader, int, error) {
+	if len(b) < proxyV2HeadSize {
+		return nil, 0, nil
+	}
+	verCmd, fam := b[12], b[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, ErrProxyHeader
+	}
+	size := proxyV2HeadSize + int(binary.BigEndian.Uint16(b[14:]))
+	if len(b) < size {
+		return nil, 0, nil
+	}
+
+	h := &ProxyHeader{Version: 2}
+	// the buffer may be reused after parsing
+	body := append([]byte(nil), b[proxyV2HeadSize:size]...)
+	af, proto := fam>>4, fam&0xF
+	addrSize := 0
+	switch af {
+	case proxyV2AFUnspec:
+	case proxyV2AFInet:
+		addrSize = proxyV2Inet4Size
+	case proxyV2AFInet6:
+		addrSize = proxyV2Inet6Size
+	case proxyV2AFUnix:
+		addrSize = proxyV2UnixSize
+	default:
+		return nil, 0, ErrProxyHeader
+	}
+	if len(body) < addrSize || proto > proxyV2Dgram {
+		return nil, 0, ErrProxyHeader
+	}
+
+	switch verCmd & 0xF {
+	case proxyV2CmdLocal:
+		// the addrs are ignored
+		h.Local = true
+	case proxyV2CmdProxy:
+		if af == proxyV2AFUnspec || proto == 0 {
+			h.Local = true
+			break
+		}
+		h.SourceAddr, h.DestinationAddr = parseProxyAddrs(af, proto, body[:addrSize])
+	default:
+		return nil, 0, ErrProxyHeader
+	}
+
+	for tlvs := body[addrSize:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, ErrProxyHeader
+		}
+		n := 3 + int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < n {
+			return nil, 0, ErrProxyHeader
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3:n:n]})
+		tlvs = tlvs[n:]
+	}
+	return h, size, nil
+}
+
+func parseProxyAddrs(af, proto byte, b []byte) (net.Addr, net.Addr) {
+	if af == proxyV2AFUnix {
+		network := "unix"
+		if proto == proxyV2Dgram {
+			network = "unixgram"
+		}
+		half := proxyV2UnixSize / 2
+		src := &net.UnixAddr{Name: string(bytes.TrimRight(b[:half], "\x00")), Net: network}
+		dst := &net.UnixAddr{Name: string(bytes.TrimRight(b[half:], "\x00")), Net: network}
+		return src, dst
+	}
+
+	ipLen := net.IPv4len
+	if af == proxyV2AFInet6 {
+		ipLen = net.IPv6len
+	}
+	srcIP := net.IP(b[:ipLen])
+	dstIP := net.IP(b[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
+	if proto == proxyV2Dgram {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+}
+
+// proxyReader buffers the PROXY protocol header of a conn accepted until it's complete.
+type proxyReader struct {
+	buf   []byte
+	timer *htimer
+}
+
+// ProxyHeader returns the PROXY protocol header received, it returns nil if ProxyProtocol is not enabled
+// or the Conn is not accepted by a listener.
+func (c *Conn) ProxyHeader() *ProxyHeader {
+	return c.proxyHeader
+}
+
+// WriteProxyHeader writes h to the Conn, it should be called before writing anything else
+// on a Conn dialed to a server expecting a PROXY protocol header.
+func (c *Conn) WriteProxyHeader(h *ProxyHeader) error {
+	b, err := h.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(b)
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package nbio
+
+import (
+	"time"
+)
+
+// readProxyHeader reads the PROXY protocol header of a Conn accepted in ProxyProtocolTimeout,
+// then OnOpen is called, then OnData with the data read after the header, and the Conn is read as usual.
+func (p *poller) readProxyHeader(c *Conn) {
+	pr := c.proxy
+	c.conn.SetReadDeadline(time.Now().Add(p.g.proxyProtocolTimeout))
+	buffer := p.g.borrow(c)
+	var h *ProxyHeader
+	var size int
+	for h == nil {
+		n, err := c.conn.Read(buffer)
+		c.statsRead(n)
+		if n > 0 {
+			pr.buf = append(pr.buf, buffer[:n]...)
+			h, size, err = parseProxyHeader(pr.buf)
+		}
+		if isTimeout(err) {
+			err = ErrProxyHeaderTimeout
+		}
+		if err != nil {
+			p.g.payback(c, buffer)
+			c.CloseWithError(err)
+			return
+		}
+	}
+	p.g.payback(c, buffer)
+	c.conn.SetReadDeadline(time.Time{})
+
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return
+	}
+	c.proxy = nil
+	c.proxyHeader = h
+	c.mux.Unlock()
+
+	p.g.onOpen(c)
+	if data := pr.buf[size:]; len(data) > 0 {
+		p.g.onData(c, data)
+	}
+	p.readConn(c)
+}
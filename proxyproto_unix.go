@@ -0,0 +1,73 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"io"
+	"syscall"
+	"time"
+)
+
+// waitProxyHeader closes the Conn with ErrProxyHeaderTimeout if its PROXY protocol header is not complete in timeout.
+func (c *Conn) waitProxyHeader(timeout time.Duration) {
+	c.mux.Lock()
+	if !c.closed && c.proxy != nil {
+		c.proxy.timer = c.afterFunc(timeout, func() { c.closeWithError(ErrProxyHeaderTimeout) })
+	}
+	c.mux.Unlock()
+}
+
+// readProxyHeader is called by the poller when a Conn waiting for the PROXY protocol header is readable,
+// OnOpen is called when the header is complete, then OnData with the data read after it.
+func (c *Conn) readProxyHeader() {
+	pr := c.proxy
+	buffer := c.g.borrow(c)
+	n, err := c.Read(buffer)
+	if n > 0 {
+		pr.buf = append(pr.buf, buffer[:n]...)
+	}
+	c.g.payback(c, buffer)
+	if err == syscall.EINTR || err == syscall.EAGAIN {
+		return
+	}
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		c.closeWithError(err)
+		return
+	}
+
+	h, size, err := parseProxyHeader(pr.buf)
+	if err != nil {
+		c.closeWithError(err)
+		return
+	}
+	if h == nil {
+		return
+	}
+
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return
+	}
+	if pr.timer != nil {
+		pr.timer.Stop()
+	}
+	c.proxy = nil
+	c.proxyHeader = h
+	if !h.Local {
+		c.rAddr, c.lAddr = h.SourceAddr, h.DestinationAddr
+	}
+	c.mux.Unlock()
+
+	c.g.onOpen(c)
+	if data := pr.buf[size:]; len(data) > 0 {
+		c.g.onData(c, data)
+	}
+}
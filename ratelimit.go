@@ -0,0 +1,123 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxInt = int(^uint(0) >> 1)
+
+	// rateLimitChunk is the max size of the min quota of a rateLimiter, to avoid tiny reads and writes.
+	rateLimitChunk = 16 * 1024
+)
+
+// rateLimiter limits the bytes transferred per second, it's thread safe.
+type rateLimiter struct {
+	mux    sync.Mutex
+	bucket tokenBucket
+	chunk  float64
+}
+
+// newRateLimiter returns nil if rate <= 0, burst is set to rate if it's <= 0.
+func newRateLimiter(rate, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	l := &rateLimiter{bucket: newTokenBucket(float64(rate), burst, time.Now())}
+	l.chunk = l.bucket.burst
+	if l.chunk > rateLimitChunk {
+		l.chunk = rateLimitChunk
+	}
+	return l
+}
+
+// quota returns the bytes allowed to be transferred now, it's 0 until a chunk is allowed.
+func (l *rateLimiter) quota(now time.Time) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.bucket.refill(now)
+	if l.bucket.tokens < l.chunk {
+		return 0
+	}
+	return int(l.bucket.tokens)
+}
+
+// delay returns the time to wait until a chunk is allowed.
+func (l *rateLimiter) delay(now time.Time) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.bucket.wait(now, l.chunk)
+}
+
+func (l *rateLimiter) consume(now time.Time, n int) {
+	l.mux.Lock()
+	l.bucket.consume(now, float64(n))
+	l.mux.Unlock()
+}
+
+// setReadLimiter sets the Conn's read limiter, it should be called with the lock held or before the Conn is added to a poller.
+func (c *Conn) setReadLimiter(l *rateLimiter) {
+	c.rLimiter = l
+	var limited int32
+	if l != nil {
+		limited = 1
+	}
+	atomic.StoreInt32(&c.rLimited, limited)
+}
+
+// readLimited returns whether the reads of the Conn are limited, it's checked without the lock on each read.
+func (c *Conn) readLimited() bool {
+	return c.g.readLimiter != nil || atomic.LoadInt32(&c.rLimited) != 0
+}
+
+// limitQuota returns the bytes allowed by both the Conn's and the Gopher's limiters, nil means no limit.
+func limitQuota(connLimiter, gLimiter *rateLimiter) int {
+	if connLimiter == nil && gLimiter == nil {
+		return maxInt
+	}
+	now := time.Now()
+	q := maxInt
+	if connLimiter != nil {
+		q = connLimiter.quota(now)
+	}
+	if gLimiter != nil && q > 0 {
+		if gq := gLimiter.quota(now); gq < q {
+			q = gq
+		}
+	}
+	return q
+}
+
+// limitDelay returns the time to wait until both the Conn's and the Gopher's limiters allow a chunk.
+func limitDelay(connLimiter, gLimiter *rateLimiter) time.Duration {
+	var d time.Duration
+	now := time.Now()
+	if connLimiter != nil {
+		d = connLimiter.delay(now)
+	}
+	if gLimiter != nil {
+		if gd := gLimiter.delay(now); gd > d {
+			d = gd
+		}
+	}
+	return d
+}
+
+func limitConsume(connLimiter, gLimiter *rateLimiter, n int) {
+	if n <= 0 || (connLimiter == nil && gLimiter == nil) {
+		return
+	}
+	now := time.Now()
+	if connLimiter != nil {
+		connLimiter.consume(now, n)
+	}
+	if gLimiter != nil {
+		gLimiter.consume(now, n)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package nbio
+
+import (
+	"net"
+	"time"
+)
+
+// SetRateLimit sets the max bytes per second read from and written to the Conn, which overrides
+// ConnReadRate and ConnWriteRate of the Gopher for it, rate <= 0 disables the limit. the Gopher's
+// ReadRate and WriteRate still apply.
+func (c *Conn) SetRateLimit(readRate, writeRate int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.setReadLimiter(newRateLimiter(readRate, 0))
+	c.wLimiter = newRateLimiter(writeRate, 0)
+	return nil
+}
+
+// initRateLimit sets the Conn's limiters by the Gopher's config, it's called before the Conn is added to a poller.
+func (c *Conn) initRateLimit() {
+	c.setReadLimiter(newRateLimiter(c.g.connReadRate, c.g.connReadBurst))
+	c.wLimiter = newRateLimiter(c.g.connWriteRate, c.g.connWriteBurst)
+}
+
+func (c *Conn) limiters() (*rateLimiter, *rateLimiter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.rLimiter, c.wLimiter
+}
+
+// waitQuota sleeps until the rate limits allow a chunk, then returns the bytes allowed, at most n.
+func waitQuota(connLimiter, gLimiter *rateLimiter, n int) int {
+	for {
+		q := limitQuota(connLimiter, gLimiter)
+		if q > 0 {
+			if q > n {
+				q = n
+			}
+			return q
+		}
+		time.Sleep(limitDelay(connLimiter, gLimiter))
+	}
+}
+
+// limitRead returns the part of buffer allowed to be read into by the rate limits, after sleeping until the rate allows.
+func (c *Conn) limitRead(buffer []byte) []byte {
+	if !c.readLimited() {
+		return buffer
+	}
+	rLimiter, _ := c.limiters()
+	if rLimiter == nil && c.g.readLimiter == nil {
+		return buffer
+	}
+	return buffer[:waitQuota(rLimiter, c.g.readLimiter, len(buffer))]
+}
+
+func (c *Conn) readConsumed(n int) {
+	if !c.readLimited() {
+		return
+	}
+	rLimiter, _ := c.limiters()
+	limitConsume(rLimiter, c.g.readLimiter, n)
+}
+
+// write writes b to the net.Conn by chunks the rate limits allow, it sleeps until the rate allows.
+func (c *Conn) write(b []byte) (int, error) {
+	_, wLimiter := c.limiters()
+	if wLimiter == nil && c.g.writeLimiter == nil {
+		return c.conn.Write(b)
+	}
+	nwrite := 0
+	for nwrite < len(b) {
+		q := waitQuota(wLimiter, c.g.writeLimiter, len(b)-nwrite)
+		n, err := c.conn.Write(b[nwrite : nwrite+q])
+		limitConsume(wLimiter, c.g.writeLimiter, n)
+		nwrite += n
+		if err != nil {
+			return nwrite, err
+		}
+	}
+	return nwrite, nil
+}
+
+// writev writes the buffers to the net.Conn, by chunks the rate limits allow if any.
+func (c *Conn) writev(in [][]byte) (int64, error) {
+	_, wLimiter := c.limiters()
+	if wLimiter == nil && c.g.writeLimiter == nil {
+		buffers := net.Buffers(in)
+		return buffers.WriteTo(c.conn)
+	}
+	var nwrite int64
+	for _, b := range in {
+		n, err := c.write(b)
+		nwrite += int64(n)
+		if err != nil {
+			return nwrite, err
+		}
+	}
+	return nwrite, nil
+}
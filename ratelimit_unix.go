@@ -0,0 +1,123 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"errors"
+)
+
+// SetRateLimit sets the max bytes per second read from and written to the Conn, which overrides
+// ConnReadRate and ConnWriteRate of the Gopher for it, rate <= 0 disables the limit. the Gopher's
+// ReadRate and WriteRate still apply. tcp and unix Conns only.
+func (c *Conn) SetRateLimit(readRate, writeRate int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	if c.typ != connTypeTCP && c.typ != connTypeUnix {
+		return errors.New("not supported")
+	}
+	c.setReadLimiter(newRateLimiter(readRate, 0))
+	c.wLimiter = newRateLimiter(writeRate, 0)
+	return nil
+}
+
+// initRateLimit sets the Conn's limiters by the Gopher's config, it's called before the Conn is added to a poller.
+func (c *Conn) initRateLimit() {
+	if c.typ == connTypeTCP || c.typ == connTypeUnix {
+		c.setReadLimiter(newRateLimiter(c.g.connReadRate, c.g.connReadBurst))
+		c.wLimiter = newRateLimiter(c.g.connWriteRate, c.g.connWriteBurst)
+	}
+}
+
+// limitRead returns the part of buffer allowed to be read into by the rate limits, or nil after
+// the reading is throttled, which is resumed by a timer when the rate allows.
+func (c *Conn) limitRead(buffer []byte) []byte {
+	if (c.typ != connTypeTCP && c.typ != connTypeUnix) || !c.readLimited() {
+		return buffer
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	q := limitQuota(c.rLimiter, c.g.readLimiter)
+	if q >= len(buffer) {
+		return buffer
+	}
+	if q > 0 {
+		return buffer[:q]
+	}
+	if !c.closed && c.rThrottle == nil {
+		if !c.readDisabled() {
+			c.g.pollers[c.Hash()%len(c.g.pollers)].pauseRead(c.fd, c.isWAdded)
+		}
+		c.rThrottle = c.afterFunc(limitDelay(c.rLimiter, c.g.readLimiter), c.unthrottleRead)
+	}
+	return nil
+}
+
+func (c *Conn) unthrottleRead() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.rThrottle = nil
+	if !c.closed && !c.readDisabled() {
+		c.g.pollers[c.Hash()%len(c.g.pollers)].resumeRead(c.fd, c.isWAdded)
+	}
+}
+
+// readConsumed is called by the poller after n bytes are read.
+func (c *Conn) readConsumed(n int) {
+	if (c.typ != connTypeTCP && c.typ != connTypeUnix) || !c.readLimited() {
+		return
+	}
+	c.mux.Lock()
+	limitConsume(c.rLimiter, c.g.readLimiter, n)
+	c.mux.Unlock()
+}
+
+// readDisabled returns whether the read events should not be waited for, which is paused by the application,
+// splice or the rate limits, it should be called with the lock held.
+func (c *Conn) readDisabled() bool {
+	return c.readPaused || c.splicePaused || c.rThrottle != nil
+}
+
+// writeQuota returns the bytes allowed to be written by the rate limits, it should be called with the lock held.
+func (c *Conn) writeQuota() int {
+	if c.typ != connTypeTCP && c.typ != connTypeUnix {
+		return maxInt
+	}
+	return limitQuota(c.wLimiter, c.g.writeLimiter)
+}
+
+// writeConsumed should be called with the lock held after n bytes are written.
+func (c *Conn) writeConsumed(n int) {
+	if c.typ == connTypeTCP || c.typ == connTypeUnix {
+		limitConsume(c.wLimiter, c.g.writeLimiter, n)
+	}
+}
+
+// throttleWrite stops waiting for writable events if the rate limits don't allow writing, then the Conn is
+// flushed by a timer when the rate allows. it should be called with the lock held.
+func (c *Conn) throttleWrite() bool {
+	if c.wThrottle != nil {
+		return true
+	}
+	if c.typ != connTypeTCP && c.typ != connTypeUnix {
+		return false
+	}
+	d := limitDelay(c.wLimiter, c.g.writeLimiter)
+	if d <= 0 {
+		return false
+	}
+	c.resetRead()
+	c.wThrottle = c.afterFunc(d, func() {
+		c.mux.Lock()
+		c.wThrottle = nil
+		c.mux.Unlock()
+		c.flush()
+	})
+	return true
+}
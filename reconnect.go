@@ -0,0 +1,335 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReconnectMinBackoff .
+	DefaultReconnectMinBackoff = time.Millisecond * 100
+
+	// DefaultReconnectMaxBackoff .
+	DefaultReconnectMaxBackoff = time.Second * 30
+
+	// DefaultReconnectBackoffFactor .
+	DefaultReconnectBackoffFactor = 2.0
+
+	// DefaultReconnectDialTimeout .
+	DefaultReconnectDialTimeout = time.Second * 10
+)
+
+var (
+	errDisconnected  = errors.New("disconnected")
+	errWriteOverflow = errors.New("write buffer overflow")
+)
+
+// ReconnectConfig of ReconnectConn
+type ReconnectConfig struct {
+	// Network and Addr are used to dial the remote.
+	Network string
+	Addr    string
+
+	// DialTimeout represents timeout for each dialing, it's set to 10s by default.
+	DialTimeout time.Duration
+
+	// MinBackoff represents the delay before the first redialing, it's set to 100ms by default.
+	MinBackoff time.Duration
+
+	// MaxBackoff represents the max delay between redialing, it's set to 30s by default.
+	MaxBackoff time.Duration
+
+	// BackoffFactor represents the multiplier of the delay after each failed dialing, it's set to 2 by default.
+	BackoffFactor float64
+
+	// Jitter represents the random factor of the delay, in the range of [0, 1].
+	// the delay is randomized in [delay*(1-Jitter), delay*(1+Jitter)].
+	Jitter float64
+
+	// MaxBufferedSize represents the max size of data buffered while disconnected, the buffered data
+	// is sent after reconnected, before OnConnected. writing fails while disconnected if it's 0, which is the default value.
+	MaxBufferedSize int
+}
+
+// ReconnectConn is a client connection managed by a Gopher, which redials when the connection is lost.
+type ReconnectConn struct {
+	mux sync.Mutex
+
+	g    *Gopher
+	conf ReconnectConfig
+
+	conn     *Conn
+	lastConn *Conn
+	dialing  bool
+	stopped  bool
+	attempts int
+	timer    *Timer
+
+	pending     [][]byte
+	pendingSize int
+
+	onConnected    func(c *Conn)
+	onDisconnected func(c *Conn, err error)
+}
+
+// NewReconnectConn creates a ReconnectConn, call Start to dial.
+func (g *Gopher) NewReconnectConn(conf ReconnectConfig) *ReconnectConn {
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = DefaultReconnectDialTimeout
+	}
+	if conf.MinBackoff <= 0 {
+		conf.MinBackoff = DefaultReconnectMinBackoff
+	}
+	if conf.MaxBackoff < conf.MinBackoff {
+		conf.MaxBackoff = DefaultReconnectMaxBackoff
+		if conf.MaxBackoff < conf.MinBackoff {
+			conf.MaxBackoff = conf.MinBackoff
+		}
+	}
+	if conf.BackoffFactor < 1 {
+		conf.BackoffFactor = DefaultReconnectBackoffFactor
+	}
+	if conf.Jitter < 0 {
+		conf.Jitter = 0
+	}
+	if conf.Jitter > 1 {
+		conf.Jitter = 1
+	}
+
+	return &ReconnectConn{
+		g:              g,
+		conf:           conf,
+		onConnected:    func(c *Conn) {},
+		onDisconnected: func(c *Conn, err error) {},
+	}
+}
+
+// OnConnected registers callback for each successful dialing, after Gopher's OnOpen.
+func (rc *ReconnectConn) OnConnected(h func(c *Conn)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	rc.onConnected = h
+}
+
+// OnDisconnected registers callback for connection lost, after Gopher's OnClose.
+func (rc *ReconnectConn) OnDisconnected(h func(c *Conn, err error)) {
+	if h == nil {
+		panic("invalid nil handler")
+	}
+	rc.onDisconnected = h
+}
+
+// Start dials the remote, redialing is scheduled automatically if it fails.
+func (rc *ReconnectConn) Start() {
+	rc.g.mux.Lock()
+	if rc.g.reconns == nil {
+		rc.g.reconns = map[*ReconnectConn]struct{}{}
+	}
+	rc.g.reconns[rc] = struct{}{}
+	rc.g.mux.Unlock()
+
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if !rc.stopped && rc.conn == nil && !rc.dialing {
+		rc.dial()
+	}
+}
+
+// Conn returns the current connection, it's nil while disconnected.
+func (rc *ReconnectConn) Conn() *Conn {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	return rc.conn
+}
+
+// Write writes to the current connection, or buffers the data while disconnected.
+func (rc *ReconnectConn) Write(b []byte) (int, error) {
+	return rc.Writev([][]byte{b})
+}
+
+// Writev writes to the current connection, or buffers the data while disconnected.
+func (rc *ReconnectConn) Writev(in [][]byte) (int, error) {
+	rc.mux.Lock()
+	c := rc.conn
+	if c != nil {
+		rc.mux.Unlock()
+		if len(in) == 1 {
+			return c.Write(in[0])
+		}
+		return c.Writev(in)
+	}
+
+	size := 0
+	for _, v := range in {
+		size += len(v)
+	}
+	var err error
+	switch {
+	case rc.stopped:
+		err = errClosed
+	case rc.conf.MaxBufferedSize <= 0:
+		err = errDisconnected
+	case rc.pendingSize+size > rc.conf.MaxBufferedSize:
+		err = errWriteOverflow
+	}
+	if err != nil {
+		lastConn := rc.lastConn
+		rc.mux.Unlock()
+		for _, v := range in {
+			rc.g.onWriteBufferFree(lastConn, v)
+		}
+		return 0, err
+	}
+	rc.pending = append(rc.pending, in...)
+	rc.pendingSize += size
+	rc.mux.Unlock()
+	return size, nil
+}
+
+// Close stops redialing and closes the current connection, buffered data is dropped.
+func (rc *ReconnectConn) Close() error {
+	rc.g.mux.Lock()
+	delete(rc.g.reconns, rc)
+	rc.g.mux.Unlock()
+
+	c := rc.stop()
+	if c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+func (rc *ReconnectConn) stop() *Conn {
+	rc.mux.Lock()
+	rc.stopped = true
+	if rc.timer != nil {
+		rc.timer.Stop()
+		rc.timer = nil
+	}
+	c := rc.conn
+	rc.conn = nil
+	pending := rc.pending
+	rc.pending = nil
+	rc.pendingSize = 0
+	lastConn := rc.lastConn
+	rc.mux.Unlock()
+
+	for _, v := range pending {
+		rc.g.onWriteBufferFree(lastConn, v)
+	}
+	return c
+}
+
+// dial must be called with rc.mux locked.
+func (rc *ReconnectConn) dial() {
+	rc.dialing = true
+	rc.timer = nil
+	rc.mux.Unlock()
+	rc.g.DialAsync(rc.conf.Network, rc.conf.Addr, rc.conf.DialTimeout, rc.onDial)
+	rc.mux.Lock()
+}
+
+func (rc *ReconnectConn) onDial(c *Conn, err error) {
+	rc.mux.Lock()
+	rc.dialing = false
+	if rc.stopped {
+		rc.mux.Unlock()
+		if c != nil {
+			c.Close()
+		}
+		return
+	}
+	if err != nil {
+		rc.scheduleDial()
+		rc.mux.Unlock()
+		return
+	}
+
+	c.mux.Lock()
+	closed := c.closed
+	c.mux.Unlock()
+	if closed {
+		rc.scheduleDial()
+		rc.mux.Unlock()
+		return
+	}
+
+	rc.attempts = 0
+	rc.lastConn = c
+	if len(rc.pending) > 0 {
+		// flush the buffered data before rc.conn is published, so that the data written after doesn't
+		// overtake it. c.reconn is not set yet, so a failed write doesn't call back into rc with rc.mux held.
+		pending := rc.pending
+		rc.pending = nil
+		rc.pendingSize = 0
+		c.Writev(pending)
+	}
+
+	c.mux.Lock()
+	closed = c.closed
+	if !closed {
+		c.reconn = rc
+	}
+	c.mux.Unlock()
+	if closed {
+		rc.scheduleDial()
+		rc.mux.Unlock()
+		return
+	}
+	rc.conn = c
+	rc.mux.Unlock()
+
+	rc.onConnected(c)
+}
+
+// onClose is called by the poller after Gopher's OnClose.
+func (rc *ReconnectConn) onClose(c *Conn, err error) {
+	rc.mux.Lock()
+	if rc.conn != c {
+		rc.mux.Unlock()
+		return
+	}
+	rc.conn = nil
+	if !rc.stopped {
+		rc.scheduleDial()
+	}
+	rc.mux.Unlock()
+
+	rc.onDisconnected(c, err)
+}
+
+// scheduleDial must be called with rc.mux locked.
+func (rc *ReconnectConn) scheduleDial() {
+	delay := rc.backoff()
+	rc.attempts++
+	rc.dialing = true
+	rc.timer = rc.g.AfterFunc(delay, func() {
+		rc.mux.Lock()
+		defer rc.mux.Unlock()
+		rc.dialing = false
+		if !rc.stopped && rc.conn == nil {
+			rc.dial()
+		}
+	})
+}
+
+func (rc *ReconnectConn) backoff() time.Duration {
+	delay := float64(rc.conf.MinBackoff)
+	for i := 0; i < rc.attempts && delay < float64(rc.conf.MaxBackoff); i++ {
+		delay *= rc.conf.BackoffFactor
+	}
+	if delay > float64(rc.conf.MaxBackoff) {
+		delay = float64(rc.conf.MaxBackoff)
+	}
+	if rc.conf.Jitter > 0 {
+		delay += delay * rc.conf.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
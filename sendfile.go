@@ -0,0 +1,27 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"os"
+)
+
+// sendfileRangeSize returns the size of the range of f from offset, length <= 0 means to the end of f.
+func sendfileRangeSize(f *os.File, offset, length int64) (int64, error) {
+	if f == nil || offset < 0 {
+		return 0, errInvalidFile
+	}
+	if length > 0 {
+		return length, nil
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset > stat.Size() {
+		return 0, errInvalidFile
+	}
+	return stat.Size() - offset, nil
+}
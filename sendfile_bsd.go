@@ -9,10 +9,33 @@ package nbio
 import (
 	"io"
 	"os"
+	"syscall"
+
+	"github.com/lesismal/nbio/mempool"
 )
 
 const maxSendfileSize = 4 << 20
 
+// sendfileBufferSize is the max size of a file read by sendfile.
+const sendfileBufferSize = 64 << 10
+
+// sendfile reads at most size bytes of f from offset and writes them to fd, f's offset is not changed.
+func sendfile(fd int, f *os.File, offset int64, size int) (int, error) {
+	if size > sendfileBufferSize {
+		size = sendfileBufferSize
+	}
+	buf := mempool.Malloc(size)
+	defer mempool.Free(buf)
+	n, err := f.ReadAt(buf, offset)
+	if n == 0 {
+		if err == io.EOF {
+			err = nil
+		}
+		return 0, err
+	}
+	return syscall.Write(fd, buf[:n])
+}
+
 // SendFile .
 func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 	if f == nil {
@@ -13,6 +13,11 @@ import (
 
 const maxSendfileSize = 4 << 20
 
+// sendfile sends at most size bytes of f from offset to fd, f's offset is not changed.
+func sendfile(fd int, f *os.File, offset int64, size int) (int, error) {
+	return syscall.Sendfile(fd, int(f.Fd()), &offset, size)
+}
+
 // SendFile .
 func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 	if f == nil {
@@ -32,7 +37,7 @@ func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 		remain = stat.Size()
 	}
 
-	if len(c.writeBuffers) > 0 {
+	if len(c.writeBuffers) > 0 || len(c.sendfiles) > 0 {
 		if c.chWaitWrite == nil {
 			c.chWaitWrite = make(chan struct{}, 1)
 		}
@@ -60,9 +65,18 @@ func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 		if int64(n) > remain {
 			n = int(remain)
 		}
-		n, err = syscall.Sendfile(dst, src, nil, n)
+		if q := c.writeQuota(); q < n {
+			n = q
+		}
+		if n == 0 {
+			// throttled by the rate limits
+			err = syscall.EAGAIN
+		} else {
+			n, err = syscall.Sendfile(dst, src, nil, n)
+		}
 		if n > 0 {
 			remain -= int64(n)
+			c.writeConsumed(n)
 		} else if n == 0 && err == nil {
 			break
 		}
@@ -85,7 +99,7 @@ func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 		}
 		if err != nil {
 			c.closeWithErrorWithoutLock(err)
-			c.mux.Unlock()
+			c.unlock()
 			return total - remain, err
 		}
 	}
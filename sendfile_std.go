@@ -13,6 +13,33 @@ import (
 
 const maxSendfileSize = 4 << 20
 
+// SendfileRange sends length bytes of f from offset, length <= 0 means to the end of f.
+// it blocks until the segment is sent on windows, then done is called with the num of bytes sent and the error.
+func (c *Conn) SendfileRange(f *os.File, offset, length int64, done func(c *Conn, n int64, err error)) error {
+	length, err := sendfileRangeSize(f, offset, length)
+	if err != nil {
+		return err
+	}
+
+	c.g.beforeWrite(c)
+
+	n, err := io.Copy(c.conn, io.NewSectionReader(f, offset, length))
+	c.statsWrite(int(n))
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if c.closeErr == nil {
+			c.closeErr = err
+		}
+		c.Close()
+	}
+	if done != nil {
+		done(c, n, err)
+	}
+	return nil
+}
+
 // SendFile .
 func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 	if f == nil {
@@ -0,0 +1,201 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/lesismal/nbio/mempool"
+)
+
+// sendfileSegment is a range of a file queued by SendfileRange,
+// after are the buffers written after it, which are sent when it's done.
+type sendfileSegment struct {
+	f      *os.File
+	offset int64
+	remain int64
+	sent   int64
+	done   func(c *Conn, n int64, err error)
+	after  [][]byte
+	err    error
+}
+
+// SendfileRange queues length bytes of f from offset to be sent after the data written before,
+// and the data written after it waits until it's sent. it doesn't block: the segment is sent by
+// the poller when the Conn is writable, and done is called with the num of bytes sent after it's
+// sent, or with the error if the Conn fails or is closed before that, which is after OnClose.
+// done is called without the Conn's lock held, so it may write to or close the Conn. done is not called if it returns an error, which means the segment is not queued.
+// length <= 0 means to the end of f. f is not closed by nbio, keep it open until done is called.
+func (c *Conn) SendfileRange(f *os.File, offset, length int64, done func(c *Conn, n int64, err error)) error {
+	length, err := sendfileRangeSize(f, offset, length)
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return errClosed
+	}
+	if c.writeClosed {
+		c.mux.Unlock()
+		return errWriteClosed
+	}
+	if c.typ != connTypeTCP && c.typ != connTypeUnix {
+		c.mux.Unlock()
+		return errors.New("not supported")
+	}
+
+	c.g.beforeWrite(c)
+
+	c.sendfiles = append(c.sendfiles, &sendfileSegment{f: f, offset: offset, remain: length, done: done})
+
+	var finished []*sendfileSegment
+	if len(c.writeBuffers) == 0 && len(c.sendfiles) == 1 {
+		finished, err = c.flushSendfiles()
+		if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
+			// done is called with err by unlock
+			c.closeWithErrorWithoutLock(err)
+			c.unlock()
+			runSendfileDone(c, finished)
+			return nil
+		}
+	}
+	if len(c.writeBuffers) > 0 || len(c.sendfiles) > 0 {
+		c.modWrite()
+	} else if c.wTimer != nil {
+		c.wTimer.Stop()
+	}
+
+	onWatermark := c.checkWatermark()
+	c.mux.Unlock()
+	runSendfileDone(c, finished)
+	if onWatermark != nil {
+		onWatermark()
+	}
+	return nil
+}
+
+// queueAfterSendfile queues the buffers after the last file segment, it should be called with the lock held.
+func (c *Conn) queueAfterSendfile(in [][]byte) (int, error) {
+	size := 0
+	for _, b := range in {
+		size += len(b)
+	}
+	if c.overflow(size) {
+		for _, b := range in {
+			c.g.onWriteBufferFree(c, b)
+		}
+		return -1, syscall.EINVAL
+	}
+	seg := c.sendfiles[len(c.sendfiles)-1]
+	seg.after = append(seg.after, in...)
+	c.setLeftSize(c.leftSize + size)
+	return size, nil
+}
+
+// flushSendfiles sends the file segments and the buffers after them until the socket is full,
+// it should be called with the lock held and nothing in writeBuffers.
+// it returns the segments finished, whose done should be called after the lock is released.
+func (c *Conn) flushSendfiles() ([]*sendfileSegment, error) {
+	var finished []*sendfileSegment
+	for len(c.sendfiles) > 0 && len(c.writeBuffers) == 0 {
+		seg := c.sendfiles[0]
+		for seg.remain > 0 {
+			size := maxSendfileSize
+			if int64(size) > seg.remain {
+				size = int(seg.remain)
+			}
+			if q := c.writeQuota(); q < size {
+				size = q
+			}
+			if size == 0 {
+				// throttled by the rate limits
+				return finished, syscall.EAGAIN
+			}
+			n, err := sendfile(c.fd, seg.f, seg.offset, size)
+			if n > 0 {
+				seg.offset += int64(n)
+				seg.remain -= int64(n)
+				seg.sent += int64(n)
+				c.statsWrite(n)
+				c.writeConsumed(n)
+			}
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return finished, err
+			}
+			if n == 0 {
+				// the file is shorter than the range
+				return finished, io.ErrUnexpectedEOF
+			}
+		}
+
+		c.sendfiles[0] = nil
+		c.sendfiles = c.sendfiles[1:]
+		finished = append(finished, seg)
+
+		if len(seg.after) > 0 {
+			after := seg.after
+			seg.after = nil
+			size := 0
+			for _, b := range after {
+				size += len(b)
+			}
+			c.setLeftSize(c.leftSize - size)
+			var err error
+			switch len(after) {
+			case 1:
+				_, err = c.write(after[0])
+			default:
+				_, err = c.writev(after)
+			}
+			if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
+				return finished, err
+			}
+		}
+	}
+	return finished, nil
+}
+
+// closeSendfiles drops the segments not sent, it should be called with the lock held.
+// their done is called with err by unlock after the lock is released.
+func (c *Conn) closeSendfiles(err error) {
+	if err == nil {
+		err = errClosed
+	}
+	for _, seg := range c.sendfiles {
+		for _, b := range seg.after {
+			mempool.Free(b)
+		}
+		seg.after = nil
+		seg.err = err
+	}
+	c.sendfilesDropped = append(c.sendfilesDropped, c.sendfiles...)
+	c.sendfiles = nil
+}
+
+// unlock releases the lock, then calls done of the segments dropped if the Conn was closed while it was held.
+func (c *Conn) unlock() {
+	dropped := c.sendfilesDropped
+	c.sendfilesDropped = nil
+	c.mux.Unlock()
+	runSendfileDone(c, dropped)
+}
+
+func runSendfileDone(c *Conn, segs []*sendfileSegment) {
+	for _, seg := range segs {
+		if seg.done != nil {
+			seg.done(c, seg.sent, seg.err)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"errors"
+)
+
+type splicer struct{}
+
+// SpliceTo is supported on linux only.
+func (c *Conn) SpliceTo(dst *Conn) error {
+	return errors.New("not supported")
+}
+
+func (s *splicer) closed(c *Conn, err error) {}
@@ -0,0 +1,259 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package nbio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+)
+
+const (
+	spliceFlags    = 0x1 | 0x2 // SPLICE_F_MOVE | SPLICE_F_NONBLOCK
+	spliceMaxBytes = 1024 * 64
+)
+
+// splicer moves the data from src to dst through a pipe, it's driven by
+// src's read events and dst's write events.
+type splicer struct {
+	mux sync.Mutex
+
+	src  *Conn
+	dst  *Conn
+	pipe [2]int
+
+	buffered int
+	eof      bool
+	paused   bool
+	hup      bool
+	done     bool
+}
+
+// SpliceTo moves the data read from the Conn to dst with splice(2) through a pipe in the kernel,
+// instead of passing it to OnData and dst.Write. reading from the Conn is paused while dst's
+// send queue is full, and dst's writing side is shut down after all data before EOF is moved.
+// both Conns are closed if either of them is closed or fails before that.
+// for a proxy, call it on both Conns in opposite directions. tcp and unix Conns on linux only.
+func (c *Conn) SpliceTo(dst *Conn) error {
+	if c == dst || dst == nil || c.g == nil || dst.g == nil ||
+		(c.typ != connTypeTCP && c.typ != connTypeUnix) || (dst.typ != connTypeTCP && dst.typ != connTypeUnix) {
+		return errors.New("not supported")
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return err
+	}
+	s := &splicer{src: c, dst: dst, pipe: p}
+
+	// don't hold both locks, the opposite direction may be set up at the same time
+	c.mux.Lock()
+	if c.closed || c.dialer != nil || c.spliceTo != nil {
+		c.mux.Unlock()
+		s.closePipe()
+		return errClosed
+	}
+	c.spliceTo = s
+	c.mux.Unlock()
+
+	dst.mux.Lock()
+	if dst.closed || dst.dialer != nil || dst.spliceFrom != nil {
+		dst.mux.Unlock()
+		c.mux.Lock()
+		c.spliceTo = nil
+		c.mux.Unlock()
+		s.closePipe()
+		return errClosed
+	}
+	dst.spliceFrom = s
+	dst.mux.Unlock()
+
+	return nil
+}
+
+// transfer moves the data until the pipe is full and dst's send queue is full,
+// or src has nothing to read. it's called by the pollers of src and dst.
+func (s *splicer) transfer() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for i := 0; !s.done; i++ {
+		if s.buffered > 0 {
+			err := s.drain()
+			if err == syscall.EAGAIN {
+				// wait for dst's write event
+				s.pauseSrc()
+				return
+			}
+			if err != nil {
+				s.stop(err)
+				return
+			}
+		}
+		if s.eof {
+			s.finish()
+			return
+		}
+		if i == 3 && !s.hup {
+			// the read event is reported again if there is more to read
+			break
+		}
+		err := s.fill()
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil && err != syscall.EINTR {
+			s.stop(err)
+			return
+		}
+	}
+	s.resumeSrc()
+}
+
+// fill moves the data from src to the pipe.
+func (s *splicer) fill() error {
+	src := s.src
+	src.mux.Lock()
+	defer src.mux.Unlock()
+	if src.closed {
+		return errClosed
+	}
+	if src.readClosed {
+		s.eof = true
+		return nil
+	}
+	n, err := syscall.Splice(src.fd, nil, s.pipe[1], nil, spliceMaxBytes, spliceFlags)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// the peer has shut down its writing side
+		s.eof = true
+		src.readClosed = true
+		if src.writeClosed && len(src.writeBuffers) == 0 && len(src.sendfiles) == 0 {
+			src.closeWithErrorWithoutLock(io.EOF)
+		} else {
+			src.stopRead()
+		}
+		return nil
+	}
+	src.statsRead(int(n))
+	s.buffered += int(n)
+	return nil
+}
+
+// drain moves the data from the pipe to dst.
+func (s *splicer) drain() error {
+	dst := s.dst
+	dst.mux.Lock()
+	defer dst.mux.Unlock()
+	if dst.closed {
+		return errClosed
+	}
+	if len(dst.writeBuffers) > 0 || len(dst.sendfiles) > 0 {
+		// the data written by dst.Write goes first
+		dst.modWrite()
+		return syscall.EAGAIN
+	}
+	for s.buffered > 0 {
+		n, err := syscall.Splice(s.pipe[0], nil, dst.fd, nil, s.buffered, spliceFlags)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			dst.modWrite()
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		dst.statsWrite(int(n))
+		s.buffered -= int(n)
+	}
+	return nil
+}
+
+// hangup is called by src's poller for EPOLLHUP, which is reported when src's both sides
+// are shut down, but the data before the peer's FIN may have not been moved. src is removed
+// from the poller to stop the level triggered event, and it's read until EOF by transfer
+// called by dst's poller. it returns false if src should be closed as usual.
+func (s *splicer) hangup() bool {
+	s.mux.Lock()
+	if s.done || s.eof {
+		s.mux.Unlock()
+		return false
+	}
+	if !s.hup {
+		src := s.src
+		src.mux.Lock()
+		if !src.closed {
+			s.hup = true
+			src.g.pollers[src.Hash()%len(src.g.pollers)].deleteEvent(src.fd)
+		}
+		src.mux.Unlock()
+		if !s.hup {
+			s.mux.Unlock()
+			return false
+		}
+	}
+	s.mux.Unlock()
+	s.transfer()
+	return true
+}
+
+func (s *splicer) pauseSrc() {
+	if s.hup {
+		return
+	}
+	if !s.paused {
+		s.paused = true
+		s.src.setSplicePaused(true)
+	}
+}
+
+func (s *splicer) resumeSrc() {
+	if s.hup {
+		return
+	}
+	if s.paused {
+		s.paused = false
+		s.src.setSplicePaused(false)
+	}
+}
+
+// finish shuts down dst's writing side after src's EOF is moved.
+func (s *splicer) finish() {
+	s.done = true
+	s.closePipe()
+	s.dst.CloseWrite()
+}
+
+func (s *splicer) stop(err error) {
+	s.done = true
+	s.closePipe()
+	s.src.CloseWithError(err)
+	s.dst.CloseWithError(err)
+}
+
+func (s *splicer) closePipe() {
+	syscall.Close(s.pipe[0])
+	syscall.Close(s.pipe[1])
+}
+
+// closed is called when src or dst is closed, the other one is closed too,
+// unless src is closed after its EOF and the data left is still moving to dst.
+func (s *splicer) closed(c *Conn, err error) {
+	go func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if s.done || (c == s.src && s.eof) {
+			return
+		}
+		s.stop(err)
+	}()
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// close reasons for GopherStats.ClosedByReason.
+const (
+	// CloseReasonNormal represents a Conn closed with nil error, e.g. by Close.
+	CloseReasonNormal = "normal"
+	// CloseReasonEOF represents a Conn closed by the peer.
+	CloseReasonEOF = "eof"
+	// CloseReasonTimeout represents a Conn closed for read or write deadline.
+	CloseReasonTimeout = "timeout"
+	// CloseReasonIdle represents a Conn closed by the idle sweeper.
+	CloseReasonIdle = "idle"
+	// CloseReasonHandoff represents a Conn passed to another process by ServeHandoff.
+	CloseReasonHandoff = "handoff"
+	// CloseReasonError represents a Conn closed with other errors.
+	CloseReasonError = "error"
+)
+
+var closeReasons = []string{
+	CloseReasonNormal,
+	CloseReasonEOF,
+	CloseReasonTimeout,
+	CloseReasonIdle,
+	CloseReasonHandoff,
+	CloseReasonError,
+}
+
+func closeReasonIndex(err error) int {
+	switch err {
+	case nil:
+		return 0
+	case io.EOF:
+		return 1
+	case errTimeout, errReadTimeout, errWriteTimeout:
+		return 2
+	case ErrIdleTimeout:
+		return 3
+	case errHandoff:
+		return 4
+	}
+	return 5
+}
+
+// GopherStats represents a snapshot of a Gopher's statistics.
+type GopherStats struct {
+	Name string
+
+	// Online represents the num of conns added to pollers.
+	Online int64
+	// PollerConns represents the num of conns of each poller.
+	PollerConns []int64
+
+	// Accepted represents the num of conns accepted by listeners.
+	Accepted uint64
+	// Rejected represents the num of conns rejected by the acceptor.
+	Rejected uint64
+	// Closed represents the num of conns closed.
+	Closed uint64
+	// ClosedByReason represents the num of conns closed for each CloseReason*.
+	ClosedByReason map[string]uint64
+
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// PendingWriteBytes represents the size of data cached by nbio which is waiting for the kernel's sendQ.
+	PendingWriteBytes int64
+
+	// Timers represents the num of timers outstanding.
+	Timers int
+}
+
+// ConnStats represents a snapshot of a Conn's statistics.
+type ConnStats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+	CreatedAt    time.Time
+	LastRead     time.Time
+	LastWrite    time.Time
+}
+
+// gopherStats is allocated separately to keep 64-bit alignment for atomics on 32-bit platforms.
+type gopherStats struct {
+	accepted       uint64
+	rejected       uint64
+	closed         uint64
+	closedByReason [6]uint64
+	pendingWrite   int64
+}
+
+// connStats should be the first field of Conn to keep 64-bit alignment for atomics on 32-bit platforms.
+type connStats struct {
+	bytesRead    uint64
+	bytesWritten uint64
+	createdAt    int64
+	lastRead     int64
+	lastWrite    int64
+}
+
+func (g *Gopher) statsAccept() {
+	atomic.AddUint64(&g.stats.accepted, 1)
+}
+
+func (g *Gopher) statsClose(err error) {
+	atomic.AddUint64(&g.stats.closed, 1)
+	atomic.AddUint64(&g.stats.closedByReason[closeReasonIndex(err)], 1)
+}
+
+func (c *Conn) statsOpen() {
+	if atomic.LoadInt64(&c.stats.createdAt) == 0 {
+		atomic.StoreInt64(&c.stats.createdAt, time.Now().UnixNano())
+	}
+}
+
+// statsPoller returns the poller which counts the bytes of the Conn, it's nil if the Conn is not added to a Gopher.
+func (c *Conn) statsPoller() *poller {
+	if c.g == nil || len(c.g.pollers) == 0 {
+		return nil
+	}
+	return c.g.pollers[c.Hash()%len(c.g.pollers)]
+}
+
+func (c *Conn) statsRead(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&c.stats.bytesRead, uint64(n))
+	if p := c.statsPoller(); p != nil {
+		atomic.AddUint64(&p.bytesRead, uint64(n))
+		atomic.StoreInt64(&c.stats.lastRead, p.now())
+	} else {
+		atomic.StoreInt64(&c.stats.lastRead, time.Now().UnixNano())
+	}
+}
+
+func (c *Conn) statsWrite(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&c.stats.bytesWritten, uint64(n))
+	if p := c.statsPoller(); p != nil {
+		atomic.AddUint64(&p.bytesWritten, uint64(n))
+		atomic.StoreInt64(&c.stats.lastWrite, p.now())
+	} else {
+		atomic.StoreInt64(&c.stats.lastWrite, time.Now().UnixNano())
+	}
+}
+
+// Stats returns a snapshot of the Gopher's statistics.
+func (g *Gopher) Stats() *GopherStats {
+	s := &GopherStats{
+		Name:              g.Name,
+		PollerConns:       make([]int64, len(g.pollers)),
+		Accepted:          atomic.LoadUint64(&g.stats.accepted),
+		Rejected:          atomic.LoadUint64(&g.stats.rejected),
+		Closed:            atomic.LoadUint64(&g.stats.closed),
+		ClosedByReason:    make(map[string]uint64, len(closeReasons)),
+		PendingWriteBytes: atomic.LoadInt64(&g.stats.pendingWrite),
+	}
+	for i, p := range g.pollers {
+		if p != nil {
+			s.PollerConns[i] = atomic.LoadInt64(&p.online)
+			s.Online += s.PollerConns[i]
+			s.BytesRead += atomic.LoadUint64(&p.bytesRead)
+			s.BytesWritten += atomic.LoadUint64(&p.bytesWritten)
+		}
+	}
+	for i, reason := range closeReasons {
+		s.ClosedByReason[reason] = atomic.LoadUint64(&g.stats.closedByReason[i])
+	}
+	s.Timers = g.timerNum()
+
+	return s
+}
+
+// Stats returns a snapshot of the Conn's statistics.
+func (c *Conn) Stats() *ConnStats {
+	s := &ConnStats{
+		BytesRead:    atomic.LoadUint64(&c.stats.bytesRead),
+		BytesWritten: atomic.LoadUint64(&c.stats.bytesWritten),
+	}
+	if t := atomic.LoadInt64(&c.stats.createdAt); t > 0 {
+		s.CreatedAt = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&c.stats.lastRead); t > 0 {
+		s.LastRead = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&c.stats.lastWrite); t > 0 {
+		s.LastWrite = time.Unix(0, t)
+	}
+	return s
+}
@@ -6,6 +6,7 @@ package taskpool
 
 // FixedNoOrderPool .
 type FixedNoOrderPool struct {
+	size   int
 	chTask chan func()
 }
 
@@ -25,6 +26,11 @@ func (np *FixedNoOrderPool) GoByIndex(index int, f func()) {
 	np.Go(f)
 }
 
+// Stats .
+func (np *FixedNoOrderPool) Stats() Stats {
+	return Stats{Workers: np.size, Queued: len(np.chTask)}
+}
+
 // Go .
 func (np *FixedNoOrderPool) Stop() {
 	close(np.chTask)
@@ -33,6 +39,7 @@ func (np *FixedNoOrderPool) Stop() {
 // NewFixedNoOrderPool .
 func NewFixedNoOrderPool(size int, bufferSize int) *FixedNoOrderPool {
 	np := &FixedNoOrderPool{
+		size:   size,
 		chTask: make(chan func(), bufferSize),
 	}
 
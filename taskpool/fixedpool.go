@@ -95,6 +95,15 @@ func (tp *FixedPool) GoByIndex(index int, f func()) {
 	tp.pushByIndex(index, f)
 }
 
+// Stats .
+func (tp *FixedPool) Stats() Stats {
+	s := Stats{Workers: len(tp.runners), Queued: len(tp.chTask)}
+	for _, r := range tp.runners {
+		s.Queued += len(r.chTaskBy)
+	}
+	return s
+}
+
 // Stop .
 func (tp *FixedPool) Stop() {
 	if atomic.CompareAndSwapInt32(&tp.stopped, 0, 1) {
@@ -46,6 +46,13 @@ func (mp *MixedPool) GoByIndex(index int, f func()) {
 	mp.Go(f)
 }
 
+// Stats .
+func (mp *MixedPool) Stats() Stats {
+	s := mp.FixedNoOrderPool.Stats()
+	s.Workers += int(atomic.LoadInt32(&mp.cuncurrent))
+	return s
+}
+
 // Go .
 func (mp *MixedPool) Stop() {
 	close(mp.chTask)
@@ -16,6 +16,14 @@ var (
 	ErrStopped = errors.New("stopped")
 )
 
+// Stats represents a snapshot of a pool's statistics.
+type Stats struct {
+	// Workers represents the num of goroutines running or waiting for tasks.
+	Workers int
+	// Queued represents the num of tasks waiting for a worker.
+	Queued int
+}
+
 // runner .
 type runner struct {
 	parent *TaskPool
@@ -84,6 +92,11 @@ func (tp *TaskPool) GoByIndex(index int, f func()) {
 	tp.Go(f)
 }
 
+// Stats .
+func (tp *TaskPool) Stats() Stats {
+	return Stats{Workers: len(tp.chRunner), Queued: len(tp.chTask)}
+}
+
 // Stop .
 func (tp *TaskPool) Stop() {
 	if atomic.CompareAndSwapInt32(&tp.stopped, 0, 1) {
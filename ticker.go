@@ -0,0 +1,145 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"sync"
+	"time"
+)
+
+// Ticker is a periodic timer of a Gopher, used as time.Ticker.
+// the ticks are scheduled at fixed times from the start or the last Reset, so they don't drift
+// with the execution time of the callback, and the ticks missed are skipped.
+type Ticker struct {
+	// C is the channel on which the ticks are delivered for a Ticker created by NewTicker,
+	// a tick is dropped if the last one has not been received. it's nil for a Ticker created by Every.
+	C <-chan time.Time
+
+	mux     sync.Mutex
+	g       *Gopher
+	c       chan time.Time
+	f       func()
+	period  time.Duration
+	next    time.Time
+	timer   *htimer
+	seq     uint64
+	running bool
+	stopped bool
+}
+
+// arm should be called with the lock held.
+func (t *Ticker) arm() {
+	t.seq++
+	seq := t.seq
+	t.timer = t.g.afterFunc(time.Until(t.next), func() { t.fire(seq) })
+}
+
+func (t *Ticker) fire(seq uint64) {
+	t.mux.Lock()
+	if t.stopped || seq != t.seq {
+		t.mux.Unlock()
+		return
+	}
+	t.running = true
+	t.mux.Unlock()
+
+	// re-arm after the callback returns, even if it panics, so that it never runs concurrently with itself
+	defer func() {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+		t.running = false
+		if t.stopped {
+			return
+		}
+		if seq == t.seq {
+			t.next = t.next.Add(t.period)
+			if now := time.Now(); !t.next.After(now) {
+				t.next = t.next.Add((now.Sub(t.next)/t.period + 1) * t.period)
+			}
+		}
+		t.arm()
+	}()
+
+	if t.f != nil {
+		t.f()
+		return
+	}
+	select {
+	case t.c <- time.Now():
+	default:
+	}
+}
+
+// Stop turns off the Ticker, no more ticks are delivered or callbacks are called after it returns,
+// except the callback that is running.
+func (t *Ticker) Stop() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.stopped = true
+	t.seq++
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// Reset stops the Ticker and resets its period to d, the next tick arrives after d.
+// it restarts a stopped Ticker too.
+func (t *Ticker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.stopped = false
+	t.seq++
+	t.period = d
+	t.next = time.Now().Add(d)
+	// the running callback re-arms the Ticker when it returns
+	if !t.running {
+		t.arm()
+	}
+}
+
+func (g *Gopher) newTicker(d time.Duration, f func()) *Ticker {
+	t := &Ticker{
+		g:      g,
+		f:      f,
+		period: d,
+		next:   time.Now().Add(d),
+	}
+	if f == nil {
+		t.c = make(chan time.Time, 1)
+		t.C = t.c
+	}
+	t.mux.Lock()
+	t.arm()
+	t.mux.Unlock()
+	return t
+}
+
+// NewTicker returns a Ticker that delivers the time on its channel every d, used as time.NewTicker.
+func (g *Gopher) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return g.newTicker(d, nil)
+}
+
+// Every calls f every d in the timer goroutine until the returned Ticker is stopped.
+// f never runs concurrently with itself, the ticks during a long call of f are skipped.
+func (g *Gopher) Every(d time.Duration, f func()) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for Every")
+	}
+	if f == nil {
+		panic("invalid nil handler")
+	}
+	return g.newTicker(d, f)
+}
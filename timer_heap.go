@@ -18,21 +18,35 @@ type Timer struct {
 	*htimer
 }
 
-// heap timer item
+// heap timer item, or timing wheel timer item if wheel is not nil
 type htimer struct {
 	index  int
 	expire time.Time
 	f      func()
 	parent *Gopher
+
+	wheel      *timingWheel
+	expireTick uint64
+	slot       *wheelSlot
+	prev       *htimer
+	next       *htimer
 }
 
 // cancel timer
 func (it *htimer) Stop() {
+	if it.wheel != nil {
+		it.wheel.remove(it)
+		return
+	}
 	it.parent.removeTimer(it)
 }
 
 // reset timer
 func (it *htimer) Reset(timeout time.Duration) {
+	if it.wheel != nil {
+		it.wheel.reset(it, timeout)
+		return
+	}
 	it.expire = time.Now().Add(timeout)
 	it.parent.resetTimer(it)
 }
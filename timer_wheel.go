@@ -0,0 +1,264 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// the first level has 256 slots, each of the other levels has 64 slots,
+	// a timer is scheduled at most 1<<32 ticks ahead, later timers are re-scheduled when it's reached.
+	wheelBits0    = 8
+	wheelBitsN    = 6
+	wheelSize0    = 1 << wheelBits0
+	wheelSizeN    = 1 << wheelBitsN
+	wheelMask0    = wheelSize0 - 1
+	wheelMaskN    = wheelSizeN - 1
+	wheelLevels   = 5
+	wheelMaxTicks = 1<<(wheelBits0+(wheelLevels-1)*wheelBitsN) - 1
+)
+
+type wheelSlot struct {
+	head *htimer
+}
+
+func (s *wheelSlot) push(it *htimer) {
+	it.slot = s
+	it.prev = nil
+	it.next = s.head
+	if s.head != nil {
+		s.head.prev = it
+	}
+	s.head = it
+}
+
+func (s *wheelSlot) remove(it *htimer) {
+	if it.prev != nil {
+		it.prev.next = it.next
+	} else {
+		s.head = it.next
+	}
+	if it.next != nil {
+		it.next.prev = it.prev
+	}
+	it.slot, it.prev, it.next = nil, nil, nil
+}
+
+// timingWheel is a hierarchical timing wheel, each poller has its own one.
+type timingWheel struct {
+	mux sync.Mutex
+
+	g       *Gopher
+	tick    time.Duration
+	start   time.Time
+	curTick uint64
+	count   int
+	levels  [wheelLevels][]wheelSlot
+	fired   []*htimer
+
+	chWakeup chan struct{}
+}
+
+func (w *timingWheel) tickOf(t time.Time) uint64 {
+	d := t.Sub(w.start)
+	if d < 0 {
+		return 0
+	}
+	return uint64(d / w.tick)
+}
+
+// expireTickOf rounds up, so that a timer never fires before its expire.
+func (w *timingWheel) expireTickOf(t time.Time) uint64 {
+	d := t.Sub(w.start)
+	if d < 0 {
+		return 0
+	}
+	return uint64((d + w.tick - 1) / w.tick)
+}
+
+func (w *timingWheel) schedule(it *htimer) {
+	expire := it.expireTick
+	if expire < w.curTick {
+		expire = w.curTick
+	}
+	delta := expire - w.curTick
+	if delta > wheelMaxTicks {
+		delta = wheelMaxTicks
+		expire = w.curTick + delta
+	}
+	if delta < wheelSize0 {
+		w.levels[0][expire&wheelMask0].push(it)
+		return
+	}
+	level := 1
+	for delta >= 1<<(wheelBits0+uint(level)*wheelBitsN) {
+		level++
+	}
+	w.levels[level][(expire>>(wheelBits0+uint(level-1)*wheelBitsN))&wheelMaskN].push(it)
+}
+
+// cascade moves the timers of the current slot of level to lower levels.
+func (w *timingWheel) cascade(level int) int {
+	index := int(w.curTick>>(wheelBits0+uint(level-1)*wheelBitsN)) & wheelMaskN
+	s := &w.levels[level][index]
+	for s.head != nil {
+		it := s.head
+		s.remove(it)
+		w.schedule(it)
+	}
+	return index
+}
+
+func (w *timingWheel) add(it *htimer, timeout time.Duration) {
+	now := time.Now()
+	it.wheel = w
+	it.expire = now.Add(timeout)
+
+	w.mux.Lock()
+	if w.count == 0 {
+		// all slots are empty and the ticker may have been stopped, catch up with the clock
+		if t := w.tickOf(now); t > w.curTick {
+			w.curTick = t
+		}
+		select {
+		case w.chWakeup <- struct{}{}:
+		default:
+		}
+	}
+	it.expireTick = w.expireTickOf(it.expire)
+	w.schedule(it)
+	w.count++
+	w.mux.Unlock()
+}
+
+func (w *timingWheel) remove(it *htimer) {
+	w.mux.Lock()
+	if it.slot != nil {
+		it.slot.remove(it)
+		w.count--
+	}
+	w.mux.Unlock()
+}
+
+func (w *timingWheel) reset(it *htimer, timeout time.Duration) {
+	now := time.Now()
+	w.mux.Lock()
+	if it.slot != nil {
+		it.slot.remove(it)
+		it.expire = now.Add(timeout)
+		it.expireTick = w.expireTickOf(it.expire)
+		w.schedule(it)
+	}
+	w.mux.Unlock()
+}
+
+// advance runs the timers expired before now and returns the num of timers left.
+func (w *timingWheel) advance(now time.Time) int {
+	target := w.tickOf(now)
+
+	w.mux.Lock()
+	for w.curTick <= target {
+		index := int(w.curTick & wheelMask0)
+		if index == 0 {
+			for level := 1; level < wheelLevels && w.cascade(level) == 0; level++ {
+			}
+		}
+		w.curTick++
+
+		s := &w.levels[0][index]
+		for s.head != nil {
+			it := s.head
+			s.remove(it)
+			if it.expireTick >= w.curTick {
+				// it was scheduled beyond wheelMaxTicks
+				w.schedule(it)
+				continue
+			}
+			w.count--
+			w.fired = append(w.fired, it)
+		}
+	}
+	left := w.count
+	w.mux.Unlock()
+
+	for i, it := range w.fired {
+		w.g.execTimer(it.f)
+		w.fired[i] = nil
+	}
+	w.fired = w.fired[:0]
+
+	return left
+}
+
+func (w *timingWheel) len() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.count
+}
+
+// loop ticks only when there are timers.
+func (w *timingWheel) loop() {
+	defer w.g.Done()
+
+	var ticker *time.Ticker
+	var chTick <-chan time.Time
+	for {
+		select {
+		case now := <-chTick:
+			if w.advance(now) == 0 {
+				ticker.Stop()
+				ticker, chTick = nil, nil
+			}
+		case <-w.chWakeup:
+			if ticker == nil {
+				ticker = time.NewTicker(w.tick)
+				chTick = ticker.C
+			}
+		case <-w.g.chTimer:
+			if ticker != nil {
+				ticker.Stop()
+			}
+			return
+		}
+	}
+}
+
+func newTimingWheel(g *Gopher, tick time.Duration) *timingWheel {
+	w := &timingWheel{
+		g:        g,
+		tick:     tick,
+		start:    time.Now(),
+		chWakeup: make(chan struct{}, 1),
+	}
+	w.levels[0] = make([]wheelSlot, wheelSize0)
+	for i := 1; i < wheelLevels; i++ {
+		w.levels[i] = make([]wheelSlot, wheelSizeN)
+	}
+	return w
+}
+
+func (g *Gopher) initTimingWheels(tick time.Duration) {
+	g.wheels = make([]*timingWheel, g.pollerNum)
+	for i := range g.wheels {
+		g.wheels[i] = newTimingWheel(g, tick)
+	}
+}
+
+// afterFuncShard adds a timer to the timing wheel of shard, or to the timer heap if timing wheels are not used.
+func (g *Gopher) afterFuncShard(shard uint32, timeout time.Duration, f func()) *htimer {
+	if len(g.wheels) == 0 {
+		return g.afterFunc(timeout, f)
+	}
+	it := &htimer{index: -1, f: f, parent: g}
+	g.wheels[shard%uint32(len(g.wheels))].add(it, timeout)
+	return it
+}
+
+// afterFunc adds a timer to the Conn's poller's timing wheel.
+func (c *Conn) afterFunc(timeout time.Duration, f func()) *htimer {
+	return c.g.afterFuncShard(uint32(c.Hash()), timeout, f)
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lesismal/nbio/logging"
+)
+
+// maxUDPReadPerEvent limits datagrams read for a readable event to keep other conns of the poller fair.
+const maxUDPReadPerEvent = 32
+
+type udpConn struct {
+	parent *Conn
+
+	rAddr    syscall.Sockaddr
+	rAddrKey string
+
+	mux   sync.Mutex
+	conns map[string]*Conn
+}
+
+func listenUDP(network, addr string, reusePort bool) (*Conn, error) {
+	var ln net.PacketConn
+	var err error
+	if reusePort {
+		ln, err = reusePortListenConfig().ListenPacket(context.Background(), network, addr)
+	} else {
+		ln, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := ln.(*net.UDPConn)
+	if !ok {
+		ln.Close()
+		return nil, errors.New("invalid udp network: " + network)
+	}
+	c, err := dupStdConn(uc)
+	if err != nil {
+		return nil, err
+	}
+	c.typ = connTypeUDPServer
+	c.udp = &udpConn{conns: map[string]*Conn{}}
+	return c, nil
+}
+
+func (p *poller) readUDP(c *Conn) {
+	for i := 0; i < maxUDPReadPerEvent; i++ {
+		buffer := p.g.borrow(c)
+		n, sa, err := syscall.Recvfrom(c.fd, buffer, 0)
+		if err == nil && sa != nil {
+			if dst := c.udpPeer(sa); dst != nil {
+				dst.statsRead(n)
+				p.g.onData(dst, buffer[:n])
+			}
+		}
+		p.g.payback(c, buffer)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return
+		}
+		if err != nil {
+			logging.Debug("UDP[%v] Recvfrom failed: %v", c.lAddr, err)
+			return
+		}
+	}
+}
+
+// udpPeer returns the virtual Conn of the remote addr, creates it and calls OnOpen if it's a new one.
+// if virtual Conn is disabled, it returns a temporary Conn which is only valid during OnData.
+func (c *Conn) udpPeer(sa syscall.Sockaddr) *Conn {
+	g := c.g
+	key := sockaddrKey(sa)
+	if !g.udpVirtualConn {
+		return c.newUDPClient(sa, key)
+	}
+
+	c.udp.mux.Lock()
+	if c.udp.conns == nil {
+		c.udp.mux.Unlock()
+		return nil
+	}
+	dst, ok := c.udp.conns[key]
+	if !ok {
+		dst = c.newUDPClient(sa, key)
+		c.udp.conns[key] = dst
+	}
+	c.udp.mux.Unlock()
+
+	if !ok {
+		g.onOpen(dst)
+	}
+	dst.SetReadDeadline(time.Now().Add(g.udpReadTimeout))
+
+	dst.mux.Lock()
+	closed := dst.closed
+	dst.mux.Unlock()
+	if closed {
+		return nil
+	}
+	return dst
+}
+
+func (c *Conn) newUDPClient(sa syscall.Sockaddr, key string) *Conn {
+	dst := &Conn{
+		g:     c.g,
+		fd:    c.fd,
+		typ:   connTypeUDPClientFromRead,
+		lAddr: c.lAddr,
+		rAddr: sockaddrToUDPAddr(sa),
+		udp: &udpConn{
+			parent:   c,
+			rAddr:    sa,
+			rAddrKey: key,
+		},
+	}
+	dst.statsOpen()
+	return dst
+}
+
+func (c *Conn) writeUDP(b []byte) (int, error) {
+	err := syscall.Sendto(c.fd, b, 0, c.udp.rAddr)
+	c.g.onWriteBufferFree(c, b)
+	if err != nil {
+		return -1, err
+	}
+	c.statsWrite(len(b))
+	return len(b), nil
+}
+
+// writevUDP sends the buffers as one datagram.
+func (c *Conn) writevUDP(in [][]byte) (int, error) {
+	size := 0
+	for _, v := range in {
+		size += len(v)
+	}
+	b := make([]byte, 0, size)
+	for _, v := range in {
+		b = append(b, v...)
+		c.g.onWriteBufferFree(c, v)
+	}
+	err := syscall.Sendto(c.fd, b, 0, c.udp.rAddr)
+	if err != nil {
+		return -1, err
+	}
+	c.statsWrite(size)
+	return size, nil
+}
+
+// closeUDPClient removes a virtual Conn from its parent, the shared fd is owned by the parent.
+func (c *Conn) closeUDPClient() {
+	parent := c.udp.parent
+	parent.udp.mux.Lock()
+	tracked := parent.udp.conns != nil && parent.udp.conns[c.udp.rAddrKey] == c
+	if tracked {
+		delete(parent.udp.conns, c.udp.rAddrKey)
+	}
+	parent.udp.mux.Unlock()
+
+	if tracked {
+		c.g.onClose(c, c.closeErr)
+	}
+}
+
+// closeUDPClients closes all virtual Conns of a udp listener.
+func (c *Conn) closeUDPClients(err error) {
+	c.udp.mux.Lock()
+	conns := c.udp.conns
+	c.udp.conns = nil
+	c.udp.mux.Unlock()
+
+	if err == nil {
+		err = errClosed
+	}
+	for _, v := range conns {
+		v.mux.Lock()
+		if !v.closed {
+			v.closed = true
+			v.closeErr = err
+			if v.rTimer != nil {
+				v.rTimer.Stop()
+				v.rTimer = nil
+			}
+			if v.wTimer != nil {
+				v.wTimer.Stop()
+				v.wTimer = nil
+			}
+			v.mux.Unlock()
+			c.g.onClose(v, err)
+			continue
+		}
+		v.mux.Unlock()
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"syscall"
+)
+
+// sendZeroCopy is never called since MSG_ZEROCOPY is linux only.
+func (c *Conn) sendZeroCopy(b []byte) (int, bool, error) {
+	n, err := syscall.Write(c.fd, b)
+	return n, false, err
+}
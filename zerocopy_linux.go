@@ -0,0 +1,120 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package nbio
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soZeroCopy         = 0x3c
+	msgZeroCopy        = 0x4000000
+	soEEOriginZeroCopy = 5
+)
+
+// sockExtendedErr is struct sock_extended_err of linux/errqueue.h,
+// for a zero-copy completion, the sends in [info, data] are completed.
+type sockExtendedErr struct {
+	errno  uint32
+	origin uint8
+	typ    uint8
+	code   uint8
+	pad    uint8
+	info   uint32
+	data   uint32
+}
+
+// enableZeroCopy sets SO_ZEROCOPY, the Conn writes with copy if it fails.
+func (c *Conn) enableZeroCopy() {
+	if c.typ != connTypeTCP {
+		return
+	}
+	if err := syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, soZeroCopy, 1); err == nil {
+		c.zeroCopy = true
+	}
+}
+
+// sendZeroCopy sends b with MSG_ZEROCOPY, b is held until the kernel notifies
+// the completion if any byte is sent, which is returned by held. it falls back
+// to write if the kernel can't pin more pages for the socket, b is not held then.
+func (c *Conn) sendZeroCopy(b []byte) (n int, held bool, err error) {
+	n, err = syscall.SendmsgN(c.fd, b, nil, nil, msgZeroCopy)
+	if err == syscall.ENOBUFS {
+		n, err = syscall.Write(c.fd, b)
+		return n, false, err
+	}
+	if n > 0 {
+		c.zcPending = append(c.zcPending, zeroCopyBuffer{id: c.zcSeq, buf: b})
+		c.zcSeq++
+		held = true
+	}
+	return n, held, err
+}
+
+// reapZeroCopy reads the completions from the socket's error queue, the completed
+// buffers are passed to OnWriteBufferRelease. it returns the pending socket error.
+func (c *Conn) reapZeroCopy() error {
+	var oob [128]byte
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	for {
+		_, oobn, _, _, err := syscall.Recvmsg(c.fd, nil, oob[:], syscall.MSG_ERRQUEUE)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			isRecvErr := (m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR) ||
+				(m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR)
+			if !isRecvErr || len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+				continue
+			}
+			ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.origin == soEEOriginZeroCopy && ee.errno == 0 {
+				c.releaseZeroCopy(ee.info, ee.data)
+			}
+		}
+	}
+
+	errno, err := syscall.GetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
+
+// releaseZeroCopy releases the buffers of sends in [lo, hi], the ids may wrap around.
+func (c *Conn) releaseZeroCopy(lo, hi uint32) {
+	pending := c.zcPending[:0]
+	for _, v := range c.zcPending {
+		if v.id-lo <= hi-lo {
+			c.g.onWriteBufferFree(c, v.buf)
+		} else {
+			pending = append(pending, v)
+		}
+	}
+	for i := len(pending); i < len(c.zcPending); i++ {
+		c.zcPending[i] = zeroCopyBuffer{}
+	}
+	c.zcPending = pending
+}